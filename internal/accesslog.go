@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shengyanli1982/orbit/utils/log"
+)
+
+// CombinedLogTimeFormat is the timestamp layout of the Apache combined log format.
+const CombinedLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// FormatCombinedLogLine renders an orbit access log event in the Apache combined log format.
+// The event carries neither the response size, the referer nor the protocol, so they are
+// written as "-" and HTTP/1.1.
+func FormatCombinedLogLine(event *log.LogEvent, now time.Time) string {
+	target := event.Path
+	if event.ReqQuery != "" {
+		target += "?" + event.ReqQuery
+	}
+
+	var b strings.Builder
+	b.WriteString(combinedField(event.IP))
+	b.WriteString(" - - [")
+	b.WriteString(now.Format(CombinedLogTimeFormat))
+	b.WriteString("] \"")
+	b.WriteString(event.Method + " " + target + " HTTP/1.1")
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(event.Code))
+	b.WriteString(" - \"-\" \"")
+	b.WriteString(strings.ReplaceAll(event.Agent, "\"", "\\\""))
+	b.WriteString("\"\n")
+	return b.String()
+}
+
+func combinedField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shengyanli1982/orbit/utils/log"
+)
+
+func TestFormatCombinedLogLine(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", 8*3600))
+	tests := []struct {
+		name  string
+		event *log.LogEvent
+		want  string
+	}{
+		{
+			name:  "request",
+			event: &log.LogEvent{IP: "10.0.0.1", Method: "POST", Path: "/v1/chat/completions", Code: 200, Agent: "vscode/1.88"},
+			want:  `10.0.0.1 - - [05/Mar/2024:14:07:09 +0800] "POST /v1/chat/completions HTTP/1.1" 200 - "-" "vscode/1.88"` + "\n",
+		},
+		{
+			name:  "query string",
+			event: &log.LogEvent{IP: "10.0.0.1", Method: "GET", Path: "/models", ReqQuery: "a=1", Code: 404, Agent: "curl/8.5.0"},
+			want:  `10.0.0.1 - - [05/Mar/2024:14:07:09 +0800] "GET /models?a=1 HTTP/1.1" 404 - "-" "curl/8.5.0"` + "\n",
+		},
+		{
+			name:  "missing ip and quoted agent",
+			event: &log.LogEvent{Method: "GET", Path: "/_ping", Code: 200, Agent: `say "hi"`},
+			want:  `- - - [05/Mar/2024:14:07:09 +0800] "GET /_ping HTTP/1.1" 200 - "-" "say \"hi\""` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatCombinedLogLine(tt.event, now); got != tt.want {
+				t.Errorf("FormatCombinedLogLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
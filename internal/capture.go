@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var ErrorNoRecordedResponse = errors.New("no recorded response for request")
+
+// recordedExchange is a sanitized request and response pair written by the capture mode and
+// served by the replay mode. Files are named after the hash of the upstream request body.
+type recordedExchange struct {
+	RequestType     string      `json:"request_type"`
+	Method          string      `json:"method"`
+	Target          string      `json:"target"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    string      `json:"response_body"`
+}
+
+// requestBody returns a copy of the body of req, which is left readable.
+func requestBody(req *http.Request) []byte {
+	if req.GetBody == nil {
+		return nil
+	}
+	reader, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	body, _ := io.ReadAll(reader)
+	return body
+}
+
+func (s *ProxyService) exchangeFile(dir string, body []byte) string {
+	return filepath.Join(dir, s.hashRequestBody(body)+".json")
+}
+
+// replayResponse returns the response recorded in ReplayDir for req.
+func (s *ProxyService) replayResponse(req *http.Request) (*http.Response, error) {
+	content, err := os.ReadFile(s.exchangeFile(s.cfg.ReplayDir, requestBody(req)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrorNoRecordedResponse
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var exchange recordedExchange
+	if err := json.Unmarshal(content, &exchange); err != nil {
+		return nil, fmt.Errorf("malformed recorded response: %w", err)
+	}
+	return &http.Response{
+		StatusCode: exchange.Status,
+		Header:     exchange.ResponseHeaders,
+		Body:       io.NopCloser(bytes.NewReader([]byte(exchange.ResponseBody))),
+		Request:    req,
+	}, nil
+}
+
+// captureResponse tees the body of resp and writes the exchange to CaptureDir once the body
+// is closed, so streamed responses are recorded as forwarded.
+func (s *ProxyService) captureResponse(req *http.Request, requestType string, resp *http.Response) {
+	body := requestBody(req)
+	exchange := &recordedExchange{
+		RequestType:     requestType,
+		Method:          req.Method,
+		Target:          req.URL.Redacted(),
+		RequestHeaders:  redactHeaders(req.Header),
+		RequestBody:     string(redactBody(body)),
+		Status:          resp.StatusCode,
+		ResponseHeaders: redactHeaders(resp.Header),
+	}
+	path := s.exchangeFile(s.cfg.CaptureDir, body)
+
+	captured := &bytes.Buffer{}
+	resp.Body = &captureBody{
+		Reader: io.TeeReader(resp.Body, captured),
+		body:   resp.Body,
+		onClose: func() {
+			exchange.ResponseBody = captured.String()
+			content, err := json.MarshalIndent(exchange, "", "  ")
+			if err == nil {
+				err = os.WriteFile(path, content, 0o600)
+			}
+			if err != nil {
+				s.log.Errorf("Failed to capture %s exchange: %v", requestType, err)
+			}
+		},
+	}
+}
+
+type captureBody struct {
+	io.Reader
+	body    io.ReadCloser
+	onClose func()
+	closed  bool
+}
+
+func (cb *captureBody) Close() error {
+	if !cb.closed {
+		cb.closed = true
+		cb.onClose()
+	}
+	return cb.body.Close()
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	const completion = `{"choices":[{"text":"recorded"}]}`
+
+	// Capture an exchange against a live upstream
+	capturing := newTestProxy(t, &ServiceConfig{CaptureDir: dir, CodexAPIKey: "sk-secret"}, respondJSON(http.StatusOK, completion))
+	if w := capturing.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("capture status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("captured files = %d, want 1", len(files))
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exchange recordedExchange
+	if err := json.Unmarshal(content, &exchange); err != nil {
+		t.Fatalf("invalid capture %s: %v", content, err)
+	}
+	if exchange.Status != http.StatusOK || exchange.ResponseBody != completion || exchange.RequestType != RequestTypeCodex {
+		t.Errorf("exchange = %+v, want the codex request and its response", exchange)
+	}
+	if strings.Contains(string(content), "sk-secret") {
+		t.Errorf("capture leaks the api key: %s", content)
+	}
+
+	// Replay it without reaching the upstream
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "recorded request", body: `{"prompt":"p"}`, wantStatus: http.StatusOK, wantBody: completion},
+		{name: "unknown request", body: `{"prompt":"other"}`, wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			replaying := newTestProxy(t, &ServiceConfig{ReplayDir: dir}, respondJSON(http.StatusInternalServerError, `{}`))
+
+			w := replaying.do(http.MethodPost, "/v1/engines/copilot-codex/completions", tt.body, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+			if calls := replaying.upstreamCalls(); calls != 0 {
+				t.Errorf("upstream calls = %d, want 0", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSTestServer starts a TLS server answering with the protocol it served, configured by
+// configure before it starts.
+func newTLSTestServer(t *testing.T, configure func(*httptest.Server)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	if configure != nil {
+		configure(server)
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTrustingClient builds the upstream client for cfg and makes it trust server.
+func newTrustingClient(t *testing.T, cfg *ServiceConfig, server *httptest.Server) *http.Client {
+	t.Helper()
+	if cfg.MinTLSVersion == "" {
+		cfg.MinTLSVersion = DefaultMinTLSVersion
+	}
+	client, err := createHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("createHTTPClient() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	return client
+}
+
+func TestCreateHTTPClientDisableHTTP2(t *testing.T) {
+	tests := []struct {
+		name      string
+		disable   bool
+		wantProto string
+	}{
+		{name: "http2 negotiated by default", wantProto: "HTTP/2.0"},
+		{name: "http2 disabled", disable: true, wantProto: "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSTestServer(t, func(s *httptest.Server) { s.EnableHTTP2 = true })
+			client := newTrustingClient(t, &ServiceConfig{DisableHTTP2: tt.disable}, server)
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.Proto != tt.wantProto {
+				t.Errorf("proto = %s, want %s", resp.Proto, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestCreateHTTPClientHTTP2Settings(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ServiceConfig
+	}{
+		{name: "strict max concurrent streams", cfg: &ServiceConfig{HTTP2StrictMaxStreams: true}},
+		{name: "keepalive pings", cfg: &ServiceConfig{HTTP2ReadIdleTimeoutMs: 50, HTTP2PingTimeoutMs: 50}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSTestServer(t, func(s *httptest.Server) { s.EnableHTTP2 = true })
+			client := newTrustingClient(t, tt.cfg, server)
+
+			// Two requests, the second one after the idle timeout has sent a ping
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(server.URL)
+				if err != nil {
+					t.Fatalf("request %d failed: %v", i, err)
+				}
+				resp.Body.Close()
+				if resp.Proto != "HTTP/2.0" {
+					t.Errorf("proto = %s, want HTTP/2.0", resp.Proto)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// writeClientCert generates a self-signed client certificate, writes it and its key as PEM
+// files in a temporary directory and returns their paths with the certificate.
+func writeClientCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldor"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestCreateHTTPClientCertificate(t *testing.T) {
+	certFile, keyFile, cert := writeClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		wantErr bool
+	}{
+		{name: "with client certificate", cfg: &ServiceConfig{ClientCertFile: certFile, ClientKeyFile: keyFile}},
+		{name: "without client certificate", cfg: &ServiceConfig{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSTestServer(t, func(s *httptest.Server) {
+				s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+			})
+			client := newTrustingClient(t, tt.cfg, server)
+
+			resp, err := client.Get(server.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request without a client certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+
+	if _, err := createHTTPClient(&ServiceConfig{MinTLSVersion: DefaultMinTLSVersion, ClientCertFile: certFile}); err == nil {
+		t.Error("createHTTPClient() without the key file succeeded")
+	}
+}
+
+func TestCreateHTTPClientDialTimeout(t *testing.T) {
+	client, err := createHTTPClient(&ServiceConfig{MinTLSVersion: DefaultMinTLSVersion, TimeoutSeconds: 30, DialTimeoutMs: 200})
+	if err != nil {
+		t.Fatalf("createHTTPClient() error = %v", err)
+	}
+
+	// 192.0.2.0/24 is reserved for documentation and never routed
+	start := time.Now()
+	resp, err := client.Get("http://192.0.2.1:81/")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to an unroutable upstream succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request failed after %v, want within the dial timeout", elapsed)
+	}
+}
+
+func TestCreateHTTPClientMinTLSVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		wantErr    bool
+	}{
+		{name: "server version accepted", minVersion: "1.2"},
+		{name: "server version too old", minVersion: "1.3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSTestServer(t, func(s *httptest.Server) {
+				s.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+			})
+			client := newTrustingClient(t, &ServiceConfig{MinTLSVersion: tt.minVersion}, server)
+
+			resp, err := client.Get(server.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request to a TLS 1.2 server succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+
+	if _, err := createHTTPClient(&ServiceConfig{MinTLSVersion: "1.4"}); err == nil {
+		t.Error("createHTTPClient() with an unknown TLS version succeeded")
+	}
+}
@@ -3,10 +3,14 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -15,28 +19,282 @@ const (
 	DefaultMaxTokenCount     = 2048
 	DefaultLocale            = "zh_CN"
 	DefaultRequestsPerSecond = math.MaxInt16
+	DefaultChatContentPath   = "choices.#.message.content"
+	DefaultCodexTextPath     = "choices.#.text"
+	ChatStreamContentPath    = "choices.#.delta.content"
+
+	DefaultEmptyCompletionRetries = 1
+	DefaultModelsRefreshSec       = 300
+	DefaultWebhookTimeoutMs       = 2000
+	DefaultQueueTimeoutMs         = 5000
+	DefaultMinTLSVersion          = "1.2"
+	DefaultStatusHistogramMin     = 60
+)
+
+const (
+	PromptTruncateKeepTail = "keep_tail"
+	PromptTruncateKeepHead = "keep_head"
+)
+
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatText     = "text"
+	AccessLogFormatCombined = "combined"
+)
+
+const (
+	CredentialCheckWarn = "warn"
+	CredentialCheckFail = "fail"
+)
+
+// Fail modes of the rate limiter and the transform webhook.
+const (
+	FailModeOpen   = "open"
+	FailModeClosed = "closed"
+)
+
+// Overflow modes of the per-message content and logit_bias limits.
+const (
+	MessageOverflowTruncate = "truncate"
+	MessageOverflowReject   = "reject"
+)
+
+// Error categories of retry_max_attempts_by_category.
+const (
+	RetryCategoryTimeout    = "timeout"
+	RetryCategoryConnection = "connection"
+	RetryCategory5xx        = "5xx"
+	RetryCategory429        = "429"
+)
+
+// Algorithms of the request body hash.
+const (
+	HashAlgorithmSHA256 = "sha256"
+	HashAlgorithmXXHash = "xxhash"
+)
+
+// Modes of the system role downgrade.
+const (
+	SystemRoleConvert = "convert"
+	SystemRoleMerge   = "merge"
+)
+
+const (
+	PenaltyModePassthrough = "passthrough"
+	PenaltyModeClamp       = "clamp"
+	PenaltyModeStrip       = "strip"
+)
+
+var (
+	ErrorConfigNotFound  = errors.New("config file not found")
+	ErrorConfigMalformed = errors.New("config file is malformed")
+	ErrorConfigInvalid   = errors.New("config is invalid")
 )
 
+// defaultPathVariants are the prefixes under which the completion routes are registered.
+var defaultPathVariants = []string{"", "/v1"}
+
+// FileReferencePrefix marks a config value that should be read from a file.
+const FileReferencePrefix = "file:"
+
 type ServiceConfig struct {
-	BindAddress          string            `json:"bind,omitempty"`
-	ProxyURL             string            `json:"proxy_url,omitempty"`
-	TimeoutSeconds       int               `json:"timeout,omitempty"`
-	CodexAPIBaseURL      string            `json:"codex_api_base,omitempty"`
-	CodexAPIKey          string            `json:"codex_api_key,omitempty"`
-	CodexAPIOrganization string            `json:"codex_api_organization,omitempty"`
-	CodexAPIProject      string            `json:"codex_api_project,omitempty"`
-	CodexMaxTokenCount   int               `json:"codex_max_tokens,omitempty"`
-	CodeInstructionModel string            `json:"code_instruct_model,omitempty"`
-	ChatAPIBaseURL       string            `json:"chat_api_base,omitempty"`
-	ChatAPIKey           string            `json:"chat_api_key,omitempty"`
-	ChatAPIOrganization  string            `json:"chat_api_organization,omitempty"`
-	ChatAPIProject       string            `json:"chat_api_project,omitempty"`
-	ChatMaxTokenCount    int               `json:"chat_max_tokens,omitempty"`
-	ChatDefaultModel     string            `json:"chat_model_default,omitempty"`
-	ChatModelMapping     map[string]string `json:"chat_model_map,omitempty"`
-	ChatLocale           string            `json:"chat_locale,omitempty"`
-	AuthToken            string            `json:"auth_token,omitempty"`
-	MaxRequestsPerSecond int               `json:"requests_per_sec,omitempty"`
+	BindAddress          string              `json:"bind,omitempty"`
+	ProxyURL             string              `json:"proxy_url,omitempty"`
+	TimeoutSeconds       int                 `json:"timeout,omitempty"`
+	FirstByteTimeoutMs   int                 `json:"first_byte_timeout_ms,omitempty"`
+	PreShutdownDelayMs   int                 `json:"pre_shutdown_delay_ms,omitempty"`
+	APIKey               string              `json:"api_key,omitempty"`
+	APIOrganization      string              `json:"api_organization,omitempty"`
+	APIProject           string              `json:"api_project,omitempty"`
+	CodexAPIBaseURL      string              `json:"codex_api_base,omitempty"`
+	CodexAPIKey          string              `json:"codex_api_key,omitempty"`
+	CodexAPIOrganization string              `json:"codex_api_organization,omitempty"`
+	CodexAPIProject      string              `json:"codex_api_project,omitempty"`
+	CodexMaxTokenCount   int                 `json:"codex_max_tokens,omitempty"`
+	CodeInstructionModel string              `json:"code_instruct_model,omitempty"`
+	CodeSystemPrompt     string              `json:"code_system_prompt,omitempty"`
+	CodexContextPrefix   string              `json:"codex_context_prefix,omitempty"`
+	ChatAPIBaseURL       string              `json:"chat_api_base,omitempty"`
+	ChatAPIKey           string              `json:"chat_api_key,omitempty"`
+	ChatAPIOrganization  string              `json:"chat_api_organization,omitempty"`
+	ChatAPIProject       string              `json:"chat_api_project,omitempty"`
+	ChatMaxTokenCount    int                 `json:"chat_max_tokens,omitempty"`
+	ChatDefaultModel     string              `json:"chat_model_default,omitempty"`
+	ChatModelMapping     map[string]string   `json:"chat_model_map,omitempty"`
+	ChatLocale           string              `json:"chat_locale,omitempty"`
+	AuthToken            string              `json:"auth_token,omitempty"`
+	MaxRequestsPerSecond int                 `json:"requests_per_sec,omitempty"`
+	ChatRequestsPerSec   int                 `json:"chat_requests_per_sec,omitempty"`
+	CodexRequestsPerSec  int                 `json:"codex_requests_per_sec,omitempty"`
+	RequireOrgProject    bool                `json:"require_org_project,omitempty"`
+	MaxHeaderBytes       int                 `json:"max_header_bytes,omitempty"`
+	AutoLocale           bool                `json:"auto_locale,omitempty"`
+	AutoLocaleMap        map[string]string   `json:"auto_locale_map,omitempty"`
+	RateLimitEnabled     *bool               `json:"rate_limit_enabled,omitempty"`
+	DebugHeaders         bool                `json:"debug_headers,omitempty"`
+	RateLimitFailMode    string              `json:"rate_limit_fail_mode,omitempty"`
+	HeaderToBody         map[string]string   `json:"header_to_body,omitempty"`
+	DeadLetterFile       string              `json:"dead_letter_file,omitempty"`
+	CredentialCheck      string              `json:"startup_credential_check,omitempty"`
+	MaxConcurrentStreams int                 `json:"max_concurrent_streams,omitempty"`
+	AccessLogFormat      string              `json:"access_log_format,omitempty"`
+	DiscoverModels       bool                `json:"discover_models,omitempty"`
+	ModelsRefreshSec     int                 `json:"discover_models_interval_sec,omitempty"`
+	PathVariants         []string            `json:"path_variants,omitempty"`
+	LogDedupWindowMs     int                 `json:"log_dedup_window_ms,omitempty"`
+	CodeTemperature      *float64            `json:"code_force_temperature,omitempty"`
+	ExposeModelHeader    bool                `json:"expose_model_header,omitempty"`
+	Environment          string              `json:"environment,omitempty"`
+	FIMPreserveFields    []string            `json:"fim_preserve_fields,omitempty"`
+	AuthQuietReject      bool                `json:"auth_quiet_reject,omitempty"`
+	ErrorMessages        map[int]string      `json:"error_messages,omitempty"`
+	StatusHistogram      bool                `json:"status_histogram,omitempty"`
+	StatusHistogramMin   int                 `json:"status_histogram_window_minutes,omitempty"`
+	RetryCategoryLimits  map[string]int      `json:"retry_max_attempts_by_category,omitempty"`
+	ModelStopSequences   map[string][]string `json:"model_stop_sequences,omitempty"`
+	HashAlgorithm        string              `json:"hash_algorithm,omitempty"`
+	HashExcludeFields    []string            `json:"hash_exclude_fields,omitempty"`
+	DebugMaxMessages     int                 `json:"debug_max_messages,omitempty"`
+	ExposeTiming         bool                `json:"expose_timing,omitempty"`
+	AutoFitMaxTokens     bool                `json:"auto_fit_max_tokens,omitempty"`
+	AutoFitSafetyMargin  int                 `json:"auto_fit_safety_margin,omitempty"`
+	ModelContextLimits   map[string]int      `json:"model_context_limits,omitempty"`
+	EnableWebSocket      bool                `json:"enable_websocket,omitempty"`
+	ModelsFile           string              `json:"models_file,omitempty"`
+	EnableModerations    bool                `json:"enable_moderations,omitempty"`
+	ModerationsAPIBase   string              `json:"moderations_api_base,omitempty"`
+	ModerationsModelMap  map[string]string   `json:"moderations_model_map,omitempty"`
+	CaptureDir           string              `json:"capture_dir,omitempty"`
+	ReplayDir            string              `json:"replay_dir,omitempty"`
+	ForwardUpstreamID    bool                `json:"forward_upstream_request_id,omitempty"`
+	UpstreamIDHeader     string              `json:"upstream_request_id_header,omitempty"`
+	WebSocketOrigins     []string            `json:"websocket_allowed_origins,omitempty"`
+
+	// Request transforms
+	ValidateRequests      bool     `json:"validate_requests,omitempty"`
+	MaxPromptChars        int      `json:"max_prompt_chars,omitempty"`
+	PromptTruncateMode    string   `json:"prompt_truncate_strategy,omitempty"`
+	MaxStopSequences      int      `json:"max_stop_sequences,omitempty"`
+	DefaultStopSequences  []string `json:"default_stop_sequences,omitempty"`
+	RespectAcceptStream   bool     `json:"respect_accept_stream,omitempty"`
+	MergeConsecutiveRoles bool     `json:"merge_consecutive_roles,omitempty"`
+	ChatDefaultMaxTokens  int      `json:"chat_default_max_tokens,omitempty"`
+	CodexDefaultMaxTokens int      `json:"codex_default_max_tokens,omitempty"`
+	PenaltyMode           string   `json:"penalty_mode,omitempty"`
+	MaxMessageBytes       int      `json:"max_message_content_bytes,omitempty"`
+	MessageOverflowMode   string   `json:"message_overflow_mode,omitempty"`
+	MaxLogitBiasEntries   int      `json:"max_logit_bias_entries,omitempty"`
+	LogitBiasOverflowMode string   `json:"logit_bias_overflow_mode,omitempty"`
+	DeadlineBodyPath      string   `json:"deadline_body_path,omitempty"`
+	ForceJSONResponse     bool     `json:"force_json_response,omitempty"`
+	JSONResponseModels    []string `json:"force_json_response_models,omitempty"`
+	DowngradeSystemRole   bool     `json:"downgrade_system_role,omitempty"`
+	SystemRoleModels      []string `json:"downgrade_system_role_models,omitempty"`
+	SystemRoleMode        string   `json:"downgrade_system_role_mode,omitempty"`
+	ChatDefaultSeed       *int64   `json:"chat_default_seed,omitempty"`
+	SeedStripModels       []string `json:"seed_strip_models,omitempty"`
+	NormalizePrompt       bool     `json:"normalize_prompt,omitempty"`
+	CodexMaxLogprobs      int      `json:"codex_max_logprobs,omitempty"`
+	NoLogprobsModels      []string `json:"codex_no_logprobs_models,omitempty"`
+	ChatMaxChoices        int      `json:"chat_max_choices,omitempty"`
+	NonStreamAgents       []string `json:"force_nonstream_agents,omitempty"`
+
+	// Response post-processing
+	ChatContentPath     string            `json:"chat_content_path,omitempty"`
+	CodexTextPath       string            `json:"codex_text_path,omitempty"`
+	ResponseContentType string            `json:"response_content_type_override,omitempty"`
+	StreamContentType   string            `json:"stream_content_type_override,omitempty"`
+	MapFinishReasons    bool              `json:"normalize_finish_reason,omitempty"`
+	FinishReasonMap     map[string]string `json:"finish_reason_map,omitempty"`
+	CodexEnsureNewline  bool              `json:"codex_ensure_trailing_newline,omitempty"`
+	CodexNewlineModels  []string          `json:"codex_trailing_newline_models,omitempty"`
+	ValidateChunks      bool              `json:"validate_stream_chunks,omitempty"`
+	ValidateGzip        bool              `json:"validate_decompression,omitempty"`
+	RewriteURLs         bool              `json:"rewrite_response_urls,omitempty"`
+	PublicBaseURL       string            `json:"public_base_url,omitempty"`
+	StreamMaxChars      int               `json:"stream_max_output_chars,omitempty"`
+	SoftContentFilter   bool              `json:"soft_content_filter,omitempty"`
+	FilterStatuses      []int             `json:"content_filter_statuses,omitempty"`
+	FilterPatterns      []string          `json:"content_filter_patterns,omitempty"`
+	SynthesizeDone      bool              `json:"synthesize_stream_done,omitempty"`
+	BufferNonSSE        bool              `json:"buffer_non_sse_responses,omitempty"`
+	EnsureResponseID    bool              `json:"ensure_response_id,omitempty"`
+
+	// Retry
+	RetryMaxJitterMs       int  `json:"retry_max_jitter_ms,omitempty"`
+	RetryOnEmptyCompletion bool `json:"retry_on_empty_completion,omitempty"`
+	EmptyCompletionRetries int  `json:"empty_completion_retries,omitempty"`
+
+	// Upstream transport
+	DisableHTTP2           bool   `json:"upstream_disable_http2,omitempty"`
+	HTTP2StrictMaxStreams  bool   `json:"upstream_http2_strict_max_concurrent_streams,omitempty"`
+	HTTP2ReadIdleTimeoutMs int    `json:"upstream_http2_read_idle_timeout_ms,omitempty"`
+	HTTP2PingTimeoutMs     int    `json:"upstream_http2_ping_timeout_ms,omitempty"`
+	ClientCertFile         string `json:"upstream_client_cert_file,omitempty"`
+	ClientKeyFile          string `json:"upstream_client_key_file,omitempty"`
+	DialTimeoutMs          int    `json:"upstream_dial_timeout_ms,omitempty"`
+	MinTLSVersion          string `json:"upstream_min_tls_version,omitempty"`
+
+	// Legacy completions upstream
+	ChatToCompletions   bool              `json:"chat_to_completions,omitempty"`
+	ChatPromptTemplates map[string]string `json:"chat_prompt_templates,omitempty"`
+	ChatPromptSuffix    string            `json:"chat_prompt_suffix,omitempty"`
+
+	// Upstream request headers
+	ForwardIdempotencyKey bool   `json:"forward_idempotency_key,omitempty"`
+	PreserveClientAuth    bool   `json:"preserve_client_auth,omitempty"`
+	InjectMetadataHeaders bool   `json:"inject_metadata_headers,omitempty"`
+	TokenLabel            string `json:"metadata_token_label,omitempty"`
+
+	// Built-in chat transform switches
+	DisableModelMapping  bool `json:"disable_model_mapping,omitempty"`
+	DisableLocale        bool `json:"disable_locale_injection,omitempty"`
+	DisableFieldDeletion bool `json:"disable_field_deletion,omitempty"`
+	DisableTokenClamp    bool `json:"disable_max_tokens_clamp,omitempty"`
+
+	// Transform webhook
+	WebhookURL       string `json:"transform_webhook_url,omitempty"`
+	WebhookTimeoutMs int    `json:"transform_webhook_timeout_ms,omitempty"`
+	WebhookFailMode  string `json:"transform_webhook_fail_mode,omitempty"`
+
+	// Queue for the max_concurrent_streams slots
+	ConcurrencyQueueSize      int `json:"concurrency_queue_size,omitempty"`
+	ConcurrencyQueueTimeoutMs int `json:"concurrency_queue_timeout_ms,omitempty"`
+
+	codexContextPrefix string
+	modelsList         []byte
+}
+
+// ConfigSearchPaths returns the locations searched for a config file when none is given.
+func ConfigSearchPaths() []string {
+	paths := []string{"./config.json", "/etc/ldor/config.json"}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "ldor", "config.json"))
+	}
+
+	return paths
+}
+
+// FindConfigFile returns explicitPath when set, otherwise the first existing file in ConfigSearchPaths.
+func FindConfigFile(explicitPath string) (string, error) {
+	if explicitPath = strings.TrimSpace(explicitPath); explicitPath != "" {
+		return explicitPath, nil
+	}
+
+	searchPaths := ConfigSearchPaths()
+	for _, path := range searchPaths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w in %s", ErrorConfigNotFound, strings.Join(searchPaths, ", "))
 }
 
 func NewServiceConfig() *ServiceConfig {
@@ -47,15 +305,78 @@ func NewServiceConfig() *ServiceConfig {
 
 func (sc *ServiceConfig) LoadConfig(filePath string) error {
 	content, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrorConfigNotFound, filePath)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	if err := json.Unmarshal(content, sc); err != nil {
-		return fmt.Errorf("failed to unmarshal config: %w", err)
+		return fmt.Errorf("%w: %w", ErrorConfigMalformed, err)
 	}
 
+	return sc.LoadDefaults()
+}
+
+// LoadDefaults fills every unset field with its default, it is used as is when the service
+// starts without a config file.
+func (sc *ServiceConfig) LoadDefaults() error {
 	sc.setDefaults()
+	if err := sc.resolveFileReferences(); err != nil {
+		return err
+	}
+	if err := sc.validateOrgProject(); err != nil {
+		return err
+	}
+	return sc.loadModelsFile()
+}
+
+// validateOrgProject checks that every upstream has an organization and a project when
+// RequireOrgProject is set, so a missing value fails the startup instead of every request.
+func (sc *ServiceConfig) validateOrgProject() error {
+	if !sc.RequireOrgProject {
+		return nil
+	}
+	if sc.CodexAPIOrganization == "" || sc.CodexAPIProject == "" {
+		return fmt.Errorf("%w: require_org_project is set but the codex organization or project is empty", ErrorConfigInvalid)
+	}
+	if sc.ChatAPIOrganization == "" || sc.ChatAPIProject == "" {
+		return fmt.Errorf("%w: require_org_project is set but the chat organization or project is empty", ErrorConfigInvalid)
+	}
+	return nil
+}
+
+// loadModelsFile reads the models list served by /models from ModelsFile, a JSON file in the
+// OpenAI models list format.
+func (sc *ServiceConfig) loadModelsFile() error {
+	if sc.ModelsFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(sc.ModelsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read models file: %w", err)
+	}
+	var list struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(content, &list); err != nil || list.Data == nil {
+		return fmt.Errorf("models file %s is not a models list", sc.ModelsFile)
+	}
+	sc.modelsList = content
+	return nil
+}
+
+// resolveFileReferences loads config values given as "file:<path>".
+func (sc *ServiceConfig) resolveFileReferences() error {
+	sc.codexContextPrefix = sc.CodexContextPrefix
+	if path, ok := strings.CutPrefix(sc.CodexContextPrefix, FileReferencePrefix); ok {
+		content, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return fmt.Errorf("failed to read codex context prefix file: %w", err)
+		}
+		sc.codexContextPrefix = string(content)
+	}
 	return nil
 }
 
@@ -66,6 +387,25 @@ func (sc *ServiceConfig) setDefaults() {
 	if sc.TimeoutSeconds == 0 {
 		sc.TimeoutSeconds = 600
 	}
+	// Shared credentials apply to every upstream without its own
+	if sc.CodexAPIKey == "" {
+		sc.CodexAPIKey = sc.APIKey
+	}
+	if sc.CodexAPIOrganization == "" {
+		sc.CodexAPIOrganization = sc.APIOrganization
+	}
+	if sc.CodexAPIProject == "" {
+		sc.CodexAPIProject = sc.APIProject
+	}
+	if sc.ChatAPIKey == "" {
+		sc.ChatAPIKey = sc.APIKey
+	}
+	if sc.ChatAPIOrganization == "" {
+		sc.ChatAPIOrganization = sc.APIOrganization
+	}
+	if sc.ChatAPIProject == "" {
+		sc.ChatAPIProject = sc.APIProject
+	}
 	if sc.CodexAPIBaseURL == "" {
 		sc.CodexAPIBaseURL = DefaultAPIBaseURL
 	}
@@ -78,6 +418,9 @@ func (sc *ServiceConfig) setDefaults() {
 	if sc.ChatAPIBaseURL == "" {
 		sc.ChatAPIBaseURL = DefaultAPIBaseURL
 	}
+	if sc.ModerationsAPIBase == "" {
+		sc.ModerationsAPIBase = sc.ChatAPIBaseURL
+	}
 	if sc.ChatMaxTokenCount == 0 {
 		sc.ChatMaxTokenCount = DefaultMaxTokenCount
 	}
@@ -90,6 +433,116 @@ func (sc *ServiceConfig) setDefaults() {
 	if sc.MaxRequestsPerSecond <= 0 {
 		sc.MaxRequestsPerSecond = DefaultRequestsPerSecond
 	}
+	if sc.ChatContentPath == "" {
+		sc.ChatContentPath = DefaultChatContentPath
+	}
+	if sc.CodexTextPath == "" {
+		sc.CodexTextPath = DefaultCodexTextPath
+	}
+	if sc.AutoLocaleMap == nil {
+		sc.AutoLocaleMap = make(map[string]string)
+	}
+	for language, locale := range defaultAutoLocaleMap {
+		if _, ok := sc.AutoLocaleMap[language]; !ok {
+			sc.AutoLocaleMap[language] = locale
+		}
+	}
+	if sc.ChatPromptTemplates == nil {
+		sc.ChatPromptTemplates = make(map[string]string)
+	}
+	for role, template := range defaultChatPromptTemplates {
+		if _, ok := sc.ChatPromptTemplates[role]; !ok {
+			sc.ChatPromptTemplates[role] = template
+		}
+	}
+	if sc.FinishReasonMap == nil {
+		sc.FinishReasonMap = make(map[string]string)
+	}
+	for reason, normalized := range defaultFinishReasonMap {
+		if _, ok := sc.FinishReasonMap[reason]; !ok {
+			sc.FinishReasonMap[reason] = normalized
+		}
+	}
+	if sc.ChatPromptSuffix == "" {
+		sc.ChatPromptSuffix = DefaultChatPromptSuffix
+	}
+	if sc.EmptyCompletionRetries <= 0 {
+		sc.EmptyCompletionRetries = DefaultEmptyCompletionRetries
+	}
+	if sc.PenaltyMode != PenaltyModeClamp && sc.PenaltyMode != PenaltyModeStrip {
+		sc.PenaltyMode = PenaltyModePassthrough
+	}
+	if sc.PromptTruncateMode != PromptTruncateKeepHead {
+		sc.PromptTruncateMode = PromptTruncateKeepTail
+	}
+	if len(sc.PathVariants) == 0 {
+		sc.PathVariants = defaultPathVariants
+	}
+	if len(sc.FilterStatuses) == 0 {
+		sc.FilterStatuses = []int{http.StatusBadRequest}
+	}
+	if len(sc.FilterPatterns) == 0 {
+		sc.FilterPatterns = defaultContentFilterPatterns
+	}
+	if sc.HashAlgorithm != HashAlgorithmXXHash {
+		sc.HashAlgorithm = HashAlgorithmSHA256
+	}
+	if sc.SystemRoleMode != SystemRoleMerge {
+		sc.SystemRoleMode = SystemRoleConvert
+	}
+	if sc.UpstreamIDHeader == "" {
+		sc.UpstreamIDHeader = HeaderRequestID
+	}
+	if sc.StatusHistogramMin <= 0 {
+		sc.StatusHistogramMin = DefaultStatusHistogramMin
+	}
+	if sc.MinTLSVersion == "" {
+		sc.MinTLSVersion = DefaultMinTLSVersion
+	}
+	if sc.ConcurrencyQueueTimeoutMs <= 0 {
+		sc.ConcurrencyQueueTimeoutMs = DefaultQueueTimeoutMs
+	}
+	if sc.WebhookTimeoutMs <= 0 {
+		sc.WebhookTimeoutMs = DefaultWebhookTimeoutMs
+	}
+	if sc.WebhookFailMode != FailModeClosed {
+		sc.WebhookFailMode = FailModeOpen
+	}
+	if sc.ModelsRefreshSec <= 0 {
+		sc.ModelsRefreshSec = DefaultModelsRefreshSec
+	}
+	if sc.AccessLogFormat != AccessLogFormatText && sc.AccessLogFormat != AccessLogFormatCombined {
+		sc.AccessLogFormat = AccessLogFormatJSON
+	}
+	if sc.RateLimitFailMode != FailModeClosed {
+		sc.RateLimitFailMode = FailModeOpen
+	}
+	if sc.MessageOverflowMode != MessageOverflowReject {
+		sc.MessageOverflowMode = MessageOverflowTruncate
+	}
+	if sc.LogitBiasOverflowMode != MessageOverflowReject {
+		sc.LogitBiasOverflowMode = MessageOverflowTruncate
+	}
+}
+
+// RateLimitingEnabled reports whether the request rate limiters should be attached, it
+// defaults to true when rate_limit_enabled is not configured.
+func (c *ServiceConfig) RateLimitingEnabled() bool {
+	return c.RateLimitEnabled == nil || *c.RateLimitEnabled
+}
+
+func formatOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func formatOptionalInt(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
 }
 
 func (c *ServiceConfig) String() string {
@@ -98,18 +551,142 @@ func (c *ServiceConfig) String() string {
 	b.WriteString("> BindAddress: " + c.BindAddress + "\n")
 	b.WriteString("> ProxyURL: " + c.ProxyURL + "\n")
 	b.WriteString("> TimeoutSeconds: " + strconv.Itoa(c.TimeoutSeconds) + "\n")
+	b.WriteString("> FirstByteTimeoutMs: " + strconv.Itoa(c.FirstByteTimeoutMs) + "\n")
+	b.WriteString("> PreShutdownDelayMs: " + strconv.Itoa(c.PreShutdownDelayMs) + "\n")
 	b.WriteString("> MaxRequestsPerSecond: " + strconv.Itoa(c.MaxRequestsPerSecond) + "\n")
+	b.WriteString("> ChatRequestsPerSec: " + strconv.Itoa(c.ChatRequestsPerSec) + "\n")
+	b.WriteString("> CodexRequestsPerSec: " + strconv.Itoa(c.CodexRequestsPerSec) + "\n")
+	b.WriteString("> APIOrganization: " + c.APIOrganization + "\n")
+	b.WriteString("> APIProject: " + c.APIProject + "\n")
 	b.WriteString("> CodexAPIBaseURL: " + c.CodexAPIBaseURL + "\n")
 	b.WriteString("> CodexAPIOrganization: " + c.CodexAPIOrganization + "\n")
 	b.WriteString("> CodexAPIProject: " + c.CodexAPIProject + "\n")
 	b.WriteString("> CodexMaxTokenCount: " + strconv.Itoa(c.CodexMaxTokenCount) + "\n")
 	b.WriteString("> CodeInstructionModel: " + c.CodeInstructionModel + "\n")
+	b.WriteString("> CodeSystemPrompt: " + c.CodeSystemPrompt + "\n")
+	b.WriteString("> CodexContextPrefix: " + c.CodexContextPrefix + "\n")
 	b.WriteString("> ChatAPIBaseURL: " + c.ChatAPIBaseURL + "\n")
 	b.WriteString("> ChatAPIOrganization: " + c.ChatAPIOrganization + "\n")
 	b.WriteString("> ChatAPIProject: " + c.ChatAPIProject + "\n")
 	b.WriteString("> ChatMaxTokenCount: " + strconv.Itoa(c.ChatMaxTokenCount) + "\n")
 	b.WriteString("> ChatDefaultModel: " + c.ChatDefaultModel + "\n")
 	b.WriteString("> ChatModelMapping: " + fmt.Sprintf("%v", c.ChatModelMapping) + "\n")
+	b.WriteString("> ValidateRequests: " + strconv.FormatBool(c.ValidateRequests) + "\n")
+	b.WriteString("> MaxPromptChars: " + strconv.Itoa(c.MaxPromptChars) + "\n")
+	b.WriteString("> PromptTruncateMode: " + c.PromptTruncateMode + "\n")
+	b.WriteString("> MaxStopSequences: " + strconv.Itoa(c.MaxStopSequences) + "\n")
+	b.WriteString("> DefaultStopSequences: " + fmt.Sprintf("%q", c.DefaultStopSequences) + "\n")
+	b.WriteString("> RespectAcceptStream: " + strconv.FormatBool(c.RespectAcceptStream) + "\n")
+	b.WriteString("> MergeConsecutiveRoles: " + strconv.FormatBool(c.MergeConsecutiveRoles) + "\n")
+	b.WriteString("> ChatContentPath: " + c.ChatContentPath + "\n")
+	b.WriteString("> CodexTextPath: " + c.CodexTextPath + "\n")
+	b.WriteString("> RetryMaxJitterMs: " + strconv.Itoa(c.RetryMaxJitterMs) + "\n")
+	b.WriteString("> DisableHTTP2: " + strconv.FormatBool(c.DisableHTTP2) + "\n")
+	b.WriteString("> HTTP2StrictMaxStreams: " + strconv.FormatBool(c.HTTP2StrictMaxStreams) + "\n")
+	b.WriteString("> HTTP2ReadIdleTimeoutMs: " + strconv.Itoa(c.HTTP2ReadIdleTimeoutMs) + "\n")
+	b.WriteString("> HTTP2PingTimeoutMs: " + strconv.Itoa(c.HTTP2PingTimeoutMs) + "\n")
+	b.WriteString("> ChatDefaultMaxTokens: " + strconv.Itoa(c.ChatDefaultMaxTokens) + "\n")
+	b.WriteString("> CodexDefaultMaxTokens: " + strconv.Itoa(c.CodexDefaultMaxTokens) + "\n")
+	b.WriteString("> PenaltyMode: " + c.PenaltyMode + "\n")
+	b.WriteString("> RequireOrgProject: " + strconv.FormatBool(c.RequireOrgProject) + "\n")
+	b.WriteString("> ChatToCompletions: " + strconv.FormatBool(c.ChatToCompletions) + "\n")
+	b.WriteString("> ChatPromptTemplates: " + fmt.Sprintf("%q", c.ChatPromptTemplates) + "\n")
+	b.WriteString("> ChatPromptSuffix: " + c.ChatPromptSuffix + "\n")
+	b.WriteString("> ClientCertFile: " + c.ClientCertFile + "\n")
+	b.WriteString("> ClientKeyFile: " + c.ClientKeyFile + "\n")
+	b.WriteString("> MaxHeaderBytes: " + strconv.Itoa(c.MaxHeaderBytes) + "\n")
+	b.WriteString("> AutoLocale: " + strconv.FormatBool(c.AutoLocale) + "\n")
+	b.WriteString("> AutoLocaleMap: " + fmt.Sprintf("%v", c.AutoLocaleMap) + "\n")
+	b.WriteString("> ResponseContentType: " + c.ResponseContentType + "\n")
+	b.WriteString("> StreamContentType: " + c.StreamContentType + "\n")
+	b.WriteString("> RetryOnEmptyCompletion: " + strconv.FormatBool(c.RetryOnEmptyCompletion) + "\n")
+	b.WriteString("> EmptyCompletionRetries: " + strconv.Itoa(c.EmptyCompletionRetries) + "\n")
+	b.WriteString("> ForwardIdempotencyKey: " + strconv.FormatBool(c.ForwardIdempotencyKey) + "\n")
+	b.WriteString("> MaxMessageBytes: " + strconv.Itoa(c.MaxMessageBytes) + "\n")
+	b.WriteString("> MessageOverflowMode: " + c.MessageOverflowMode + "\n")
+	b.WriteString("> PreserveClientAuth: " + strconv.FormatBool(c.PreserveClientAuth) + "\n")
+	b.WriteString("> MapFinishReasons: " + strconv.FormatBool(c.MapFinishReasons) + "\n")
+	b.WriteString("> FinishReasonMap: " + fmt.Sprintf("%v", c.FinishReasonMap) + "\n")
+	b.WriteString("> InjectMetadataHeaders: " + strconv.FormatBool(c.InjectMetadataHeaders) + "\n")
+	b.WriteString("> TokenLabel: " + c.TokenLabel + "\n")
+	b.WriteString("> RateLimitEnabled: " + strconv.FormatBool(c.RateLimitingEnabled()) + "\n")
+	b.WriteString("> DialTimeoutMs: " + strconv.Itoa(c.DialTimeoutMs) + "\n")
+	b.WriteString("> DebugHeaders: " + strconv.FormatBool(c.DebugHeaders) + "\n")
+	b.WriteString("> CodexEnsureNewline: " + strconv.FormatBool(c.CodexEnsureNewline) + "\n")
+	b.WriteString("> CodexNewlineModels: " + strings.Join(c.CodexNewlineModels, ",") + "\n")
+	b.WriteString("> RateLimitFailMode: " + c.RateLimitFailMode + "\n")
+	b.WriteString("> ValidateChunks: " + strconv.FormatBool(c.ValidateChunks) + "\n")
+	b.WriteString("> HeaderToBody: " + fmt.Sprintf("%v", c.HeaderToBody) + "\n")
+	b.WriteString("> DeadLetterFile: " + c.DeadLetterFile + "\n")
+	b.WriteString("> ValidateGzip: " + strconv.FormatBool(c.ValidateGzip) + "\n")
+	b.WriteString("> RewriteURLs: " + strconv.FormatBool(c.RewriteURLs) + "\n")
+	b.WriteString("> PublicBaseURL: " + c.PublicBaseURL + "\n")
+	b.WriteString("> CredentialCheck: " + c.CredentialCheck + "\n")
+	b.WriteString("> MaxConcurrentStreams: " + strconv.Itoa(c.MaxConcurrentStreams) + "\n")
+	b.WriteString("> DisableModelMapping: " + strconv.FormatBool(c.DisableModelMapping) + "\n")
+	b.WriteString("> DisableLocale: " + strconv.FormatBool(c.DisableLocale) + "\n")
+	b.WriteString("> DisableFieldDeletion: " + strconv.FormatBool(c.DisableFieldDeletion) + "\n")
+	b.WriteString("> DisableTokenClamp: " + strconv.FormatBool(c.DisableTokenClamp) + "\n")
+	b.WriteString("> AccessLogFormat: " + c.AccessLogFormat + "\n")
+	b.WriteString("> DiscoverModels: " + strconv.FormatBool(c.DiscoverModels) + "\n")
+	b.WriteString("> ModelsRefreshSec: " + strconv.Itoa(c.ModelsRefreshSec) + "\n")
+	b.WriteString("> MaxLogitBiasEntries: " + strconv.Itoa(c.MaxLogitBiasEntries) + "\n")
+	b.WriteString("> LogitBiasOverflowMode: " + c.LogitBiasOverflowMode + "\n")
+	b.WriteString("> StreamMaxChars: " + strconv.Itoa(c.StreamMaxChars) + "\n")
+	b.WriteString("> DeadlineBodyPath: " + c.DeadlineBodyPath + "\n")
+	b.WriteString("> SoftContentFilter: " + strconv.FormatBool(c.SoftContentFilter) + "\n")
+	b.WriteString("> FilterStatuses: " + fmt.Sprintf("%v", c.FilterStatuses) + "\n")
+	b.WriteString("> FilterPatterns: " + strings.Join(c.FilterPatterns, ",") + "\n")
+	b.WriteString("> PathVariants: " + strings.Join(c.PathVariants, ",") + "\n")
+	b.WriteString("> ForceJSONResponse: " + strconv.FormatBool(c.ForceJSONResponse) + "\n")
+	b.WriteString("> JSONResponseModels: " + strings.Join(c.JSONResponseModels, ",") + "\n")
+	b.WriteString("> LogDedupWindowMs: " + strconv.Itoa(c.LogDedupWindowMs) + "\n")
+	b.WriteString("> CodeTemperature: " + formatOptionalFloat(c.CodeTemperature) + "\n")
+	b.WriteString("> ExposeModelHeader: " + strconv.FormatBool(c.ExposeModelHeader) + "\n")
+	b.WriteString("> Environment: " + c.Environment + "\n")
+	b.WriteString("> WebhookURL: " + c.WebhookURL + "\n")
+	b.WriteString("> WebhookTimeoutMs: " + strconv.Itoa(c.WebhookTimeoutMs) + "\n")
+	b.WriteString("> WebhookFailMode: " + c.WebhookFailMode + "\n")
+	b.WriteString("> SynthesizeDone: " + strconv.FormatBool(c.SynthesizeDone) + "\n")
+	b.WriteString("> ConcurrencyQueueSize: " + strconv.Itoa(c.ConcurrencyQueueSize) + "\n")
+	b.WriteString("> ConcurrencyQueueTimeoutMs: " + strconv.Itoa(c.ConcurrencyQueueTimeoutMs) + "\n")
+	b.WriteString("> FIMPreserveFields: " + strings.Join(c.FIMPreserveFields, ",") + "\n")
+	b.WriteString("> AuthQuietReject: " + strconv.FormatBool(c.AuthQuietReject) + "\n")
+	b.WriteString("> ErrorMessages: " + fmt.Sprintf("%v", c.ErrorMessages) + "\n")
+	b.WriteString("> MinTLSVersion: " + c.MinTLSVersion + "\n")
+	b.WriteString("> DowngradeSystemRole: " + strconv.FormatBool(c.DowngradeSystemRole) + "\n")
+	b.WriteString("> SystemRoleModels: " + strings.Join(c.SystemRoleModels, ",") + "\n")
+	b.WriteString("> SystemRoleMode: " + c.SystemRoleMode + "\n")
+	b.WriteString("> StatusHistogram: " + strconv.FormatBool(c.StatusHistogram) + "\n")
+	b.WriteString("> StatusHistogramMin: " + strconv.Itoa(c.StatusHistogramMin) + "\n")
+	b.WriteString("> RetryCategoryLimits: " + fmt.Sprintf("%v", c.RetryCategoryLimits) + "\n")
+	b.WriteString("> ModelStopSequences: " + fmt.Sprintf("%v", c.ModelStopSequences) + "\n")
+	b.WriteString("> HashAlgorithm: " + c.HashAlgorithm + "\n")
+	b.WriteString("> HashExcludeFields: " + strings.Join(c.HashExcludeFields, ",") + "\n")
+	b.WriteString("> DebugMaxMessages: " + strconv.Itoa(c.DebugMaxMessages) + "\n")
+	b.WriteString("> ChatDefaultSeed: " + formatOptionalInt(c.ChatDefaultSeed) + "\n")
+	b.WriteString("> SeedStripModels: " + strings.Join(c.SeedStripModels, ",") + "\n")
+	b.WriteString("> ExposeTiming: " + strconv.FormatBool(c.ExposeTiming) + "\n")
+	b.WriteString("> AutoFitMaxTokens: " + strconv.FormatBool(c.AutoFitMaxTokens) + "\n")
+	b.WriteString("> AutoFitSafetyMargin: " + strconv.Itoa(c.AutoFitSafetyMargin) + "\n")
+	b.WriteString("> ModelContextLimits: " + fmt.Sprintf("%v", c.ModelContextLimits) + "\n")
+	b.WriteString("> EnableWebSocket: " + strconv.FormatBool(c.EnableWebSocket) + "\n")
+	b.WriteString("> NormalizePrompt: " + strconv.FormatBool(c.NormalizePrompt) + "\n")
+	b.WriteString("> CodexMaxLogprobs: " + strconv.Itoa(c.CodexMaxLogprobs) + "\n")
+	b.WriteString("> NoLogprobsModels: " + strings.Join(c.NoLogprobsModels, ",") + "\n")
+	b.WriteString("> ModelsFile: " + c.ModelsFile + "\n")
+	b.WriteString("> ChatMaxChoices: " + strconv.Itoa(c.ChatMaxChoices) + "\n")
+	b.WriteString("> EnableModerations: " + strconv.FormatBool(c.EnableModerations) + "\n")
+	b.WriteString("> ModerationsAPIBase: " + c.ModerationsAPIBase + "\n")
+	b.WriteString("> ModerationsModelMap: " + fmt.Sprintf("%v", c.ModerationsModelMap) + "\n")
+	b.WriteString("> NonStreamAgents: " + strings.Join(c.NonStreamAgents, ",") + "\n")
+	b.WriteString("> CaptureDir: " + c.CaptureDir + "\n")
+	b.WriteString("> ReplayDir: " + c.ReplayDir + "\n")
+	b.WriteString("> ForwardUpstreamID: " + strconv.FormatBool(c.ForwardUpstreamID) + "\n")
+	b.WriteString("> UpstreamIDHeader: " + c.UpstreamIDHeader + "\n")
+	b.WriteString("> BufferNonSSE: " + strconv.FormatBool(c.BufferNonSSE) + "\n")
+	b.WriteString("> EnsureResponseID: " + strconv.FormatBool(c.EnsureResponseID) + "\n")
+	b.WriteString("> WebSocketOrigins: " + strings.Join(c.WebSocketOrigins, ",") + "\n")
 
 	return b.String()
 }
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDefaultsValidatesOrgProject(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServiceConfig
+		wantErr error
+	}{
+		{name: "not required", cfg: ServiceConfig{}},
+		{
+			name: "shared organization and project",
+			cfg:  ServiceConfig{RequireOrgProject: true, APIOrganization: "org", APIProject: "proj"},
+		},
+		{
+			name:    "missing chat project",
+			cfg:     ServiceConfig{RequireOrgProject: true, CodexAPIOrganization: "org", CodexAPIProject: "proj", ChatAPIOrganization: "org"},
+			wantErr: ErrorConfigInvalid,
+		},
+		{
+			name:    "missing everything",
+			cfg:     ServiceConfig{RequireOrgProject: true},
+			wantErr: ErrorConfigInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.LoadDefaults(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("LoadDefaults() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSharedCredentialFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       ServiceConfig
+		wantCodex [3]string
+		wantChat  [3]string
+	}{
+		{name: "nothing set"},
+		{
+			name:      "shared credentials",
+			cfg:       ServiceConfig{APIKey: "key", APIOrganization: "org", APIProject: "proj"},
+			wantCodex: [3]string{"key", "org", "proj"},
+			wantChat:  [3]string{"key", "org", "proj"},
+		},
+		{
+			name:      "per upstream values win",
+			cfg:       ServiceConfig{APIKey: "key", APIOrganization: "org", APIProject: "proj", CodexAPIKey: "codex-key", ChatAPIProject: "chat-proj"},
+			wantCodex: [3]string{"codex-key", "org", "proj"},
+			wantChat:  [3]string{"key", "org", "chat-proj"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.LoadDefaults(); err != nil {
+				t.Fatalf("LoadDefaults() error = %v", err)
+			}
+			if got := [3]string{tt.cfg.CodexAPIKey, tt.cfg.CodexAPIOrganization, tt.cfg.CodexAPIProject}; got != tt.wantCodex {
+				t.Errorf("codex credentials = %q, want %q", got, tt.wantCodex)
+			}
+			if got := [3]string{tt.cfg.ChatAPIKey, tt.cfg.ChatAPIOrganization, tt.cfg.ChatAPIProject}; got != tt.wantChat {
+				t.Errorf("chat credentials = %q, want %q", got, tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestLoadConfigQueueKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"concurrency_queue_size":4,"concurrency_queue_timeout_ms":250}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewServiceConfig()
+	if err := cfg.LoadConfig(file); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.ConcurrencyQueueSize != 4 || cfg.ConcurrencyQueueTimeoutMs != 250 {
+		t.Errorf("queue = %d, %dms, want 4, 250ms", cfg.ConcurrencyQueueSize, cfg.ConcurrencyQueueTimeoutMs)
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	if _, err := os.Stat("/etc/ldor/config.json"); err == nil {
+		t.Skip("/etc/ldor/config.json exists on this host")
+	}
+
+	// Run from an empty working directory with an empty XDG config home
+	workDir, configHome := t.TempDir(), t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+
+	localFile := "./config.json"
+	xdgFile := filepath.Join(configHome, "ldor", "config.json")
+	if got := ConfigSearchPaths(); got[len(got)-1] != xdgFile {
+		t.Fatalf("search paths = %q, want %s last", got, xdgFile)
+	}
+
+	tests := []struct {
+		name     string
+		explicit string
+		files    []string
+		want     string
+		wantErr  error
+	}{
+		{name: "nothing found", wantErr: ErrorConfigNotFound},
+		{name: "xdg config home", files: []string{xdgFile}, want: xdgFile},
+		{name: "working directory first", files: []string{localFile, xdgFile}, want: localFile},
+		{name: "explicit path overrides", explicit: "/opt/ldor.json", files: []string{localFile}, want: "/opt/ldor.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, file := range tt.files {
+				if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(file, []byte(`{}`), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Remove(file) })
+			}
+
+			got, err := FindConfigFile(tt.explicit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FindConfigFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FindConfigFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadModelsFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	validFile := write("models.json", `{"object":"list","data":[{"id":"local-model"}]}`)
+
+	tests := []struct {
+		name    string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "not configured"},
+		{name: "models list", file: validFile, want: `{"object":"list","data":[{"id":"local-model"}]}`},
+		{name: "missing file", file: filepath.Join(dir, "missing.json"), wantErr: true},
+		{name: "malformed file", file: write("malformed.json", `{"data":[`), wantErr: true},
+		{name: "not a models list", file: write("other.json", `{"models":[]}`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{ModelsFile: tt.file}
+			err := cfg.LoadDefaults()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadDefaults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(cfg.modelsList) != tt.want {
+				t.Errorf("models list = %s, want %s", cfg.modelsList, tt.want)
+			}
+		})
+	}
+}
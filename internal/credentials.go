@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultCredentialCheckTimeout bounds each startup credential check request.
+const DefaultCredentialCheckTimeout = 10 * time.Second
+
+// upstreamCredential is an upstream and the credentials ldor uses for it.
+type upstreamCredential struct {
+	name, baseURL, apiKey, organization, project string
+}
+
+// checkCredentials calls GET /models on every configured upstream and reports the ones
+// rejecting their API key. Depending on CredentialCheck a rejection fails startup or is
+// only logged. Unreachable upstreams are always only logged.
+func checkCredentials(client *http.Client, cfg *ServiceConfig, logger *zap.SugaredLogger) error {
+	if cfg.CredentialCheck != CredentialCheckWarn && cfg.CredentialCheck != CredentialCheckFail {
+		return nil
+	}
+
+	upstreams := []upstreamCredential{
+		{"chat", cfg.ChatAPIBaseURL, cfg.ChatAPIKey, cfg.ChatAPIOrganization, cfg.ChatAPIProject},
+		{"codex", cfg.CodexAPIBaseURL, cfg.CodexAPIKey, cfg.CodexAPIOrganization, cfg.CodexAPIProject},
+	}
+
+	var rejected []string
+	for _, upstream := range upstreams {
+		if upstream.baseURL == "" {
+			continue
+		}
+		status, err := checkCredential(client, upstream)
+		switch {
+		case err != nil:
+			logger.Warnf("Credential check for %s upstream %s failed: %v", upstream.name, upstream.baseURL, err)
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			logger.Errorf("Credential check for %s upstream %s: API key rejected with status %d", upstream.name, upstream.baseURL, status)
+			rejected = append(rejected, upstream.name)
+		default:
+			logger.Infof("Credential check for %s upstream %s: status %d", upstream.name, upstream.baseURL, status)
+		}
+	}
+
+	if len(rejected) > 0 && cfg.CredentialCheck == CredentialCheckFail {
+		return fmt.Errorf("upstream credentials rejected for %v", rejected)
+	}
+	return nil
+}
+
+func checkCredential(client *http.Client, upstream upstreamCredential) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCredentialCheckTimeout)
+	defer cancel()
+
+	req, err := createProxyRequest(ctx, http.MethodGet, upstream.baseURL+"/models", nil, upstream.apiKey, upstream.organization, upstream.project, "")
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	accepting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/models" || r.Header.Get("Authorization") != "Bearer good-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(accepting.Close)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name     string
+		mode     string
+		chatKey  string
+		codexURL string
+		wantErr  bool
+	}{
+		{name: "disabled", chatKey: "bad-key", codexURL: accepting.URL},
+		{name: "accepted keys", mode: CredentialCheckFail, chatKey: "good-key", codexURL: accepting.URL},
+		{name: "rejected key fails startup", mode: CredentialCheckFail, chatKey: "bad-key", codexURL: accepting.URL, wantErr: true},
+		{name: "rejected key only warns", mode: CredentialCheckWarn, chatKey: "bad-key", codexURL: accepting.URL},
+		{name: "unreachable upstream only warns", mode: CredentialCheckFail, chatKey: "good-key", codexURL: unreachable.URL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{
+				CredentialCheck: tt.mode,
+				ChatAPIBaseURL:  accepting.URL,
+				ChatAPIKey:      tt.chatKey,
+				CodexAPIBaseURL: tt.codexURL,
+				CodexAPIKey:     "good-key",
+			}
+			err := checkCredentials(http.DefaultClient, cfg, zap.NewNop().Sugar())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
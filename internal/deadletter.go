@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// deadLetterLog writes one JSON entry per request that failed terminally, for post-mortem
+// analysis. The file is rotated like the console log.
+type deadLetterLog struct {
+	file   *lumberjack.Logger
+	logger *zap.Logger
+}
+
+func newDeadLetterLog(filename string) *deadLetterLog {
+	file := newRotatingFile(filename)
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(file), zap.InfoLevel)
+	return &deadLetterLog{file: file, logger: zap.New(core)}
+}
+
+// record writes an entry for req with its headers and body redacted.
+func (d *deadLetterLog) record(req *http.Request, requestType string, status int, err error) {
+	d.logger.Info("Request failed",
+		zap.String("requestType", requestType),
+		zap.String("method", req.Method),
+		zap.String("target", req.URL.Redacted()),
+		zap.Int("status", status),
+		zap.Error(err),
+		zap.Any("headers", redactHeaders(req.Header)),
+		zap.ByteString("body", redactBody(requestBody(req))),
+	)
+}
+
+func (d *deadLetterLog) Close() error {
+	_ = d.logger.Sync()
+	return d.file.Close()
+}
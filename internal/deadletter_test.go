@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// closeConnection is an upstream handler dropping the connection without a response.
+func closeConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestDeadLetterLog(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantEntries int
+	}{
+		{name: "success not recorded", handler: respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`)},
+		{name: "terminal failure recorded", handler: closeConnection, wantEntries: 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			file := filepath.Join(t.TempDir(), "dead-letter.log")
+			cfg := &ServiceConfig{
+				DeadLetterFile:      file,
+				CodexAPIKey:         "sk-secret",
+				RetryCategoryLimits: map[string]int{RetryCategoryConnection: 0},
+			}
+			tp := newTestProxy(t, cfg, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p","api_key":"sk-body"}`, nil)
+			// Stopping the service flushes the dead-letter log
+			tp.Stop()
+
+			entries := readDeadLetters(t, file)
+			if len(entries) != tt.wantEntries {
+				t.Fatalf("entries = %d, want %d", len(entries), tt.wantEntries)
+			}
+			if tt.wantEntries == 0 {
+				return
+			}
+
+			entry := entries[0]
+			if entry["requestType"] != RequestTypeCodex || entry["error"] == nil {
+				t.Errorf("entry = %v, want the request type and error", entry)
+			}
+			if status, _ := entry["status"].(float64); int(status) != w.Code {
+				t.Errorf("entry status = %v, want %d", entry["status"], w.Code)
+			}
+			if entry["target"] != tp.upstream.URL+"/completions" {
+				t.Errorf("entry target = %v, want %s", entry["target"], tp.upstream.URL+"/completions")
+			}
+			if body, _ := entry["body"].(string); !strings.Contains(body, `"prompt":"p"`) {
+				t.Errorf("entry body = %v, want the request body", entry["body"])
+			}
+			raw, _ := json.Marshal(entry)
+			if strings.Contains(string(raw), "sk-") {
+				t.Errorf("entry leaks a secret: %s", raw)
+			}
+		})
+	}
+}
+
+// readDeadLetters returns the entries written to a dead-letter file, none when it does not exist.
+func readDeadLetters(t *testing.T, file string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
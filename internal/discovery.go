@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// modelDiscovery periodically fetches the model list from the chat upstream's /models
+// endpoint. Until the first successful fetch, and whenever a fetch fails, the last good
+// list, the models_file list or the static defaultModels is served instead.
+type modelDiscovery struct {
+	client   *http.Client
+	cfg      *ServiceConfig
+	log      *zap.SugaredLogger
+	models   atomic.Pointer[[]byte]
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newModelDiscovery(client *http.Client, cfg *ServiceConfig, logger *zap.SugaredLogger) *modelDiscovery {
+	return &modelDiscovery{client: client, cfg: cfg, log: logger, stopCh: make(chan struct{})}
+}
+
+// start refreshes the model list right away and then every ModelsRefreshSec seconds.
+func (md *modelDiscovery) start() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(md.cfg.ModelsRefreshSec) * time.Second)
+		defer ticker.Stop()
+		for {
+			md.refresh()
+			select {
+			case <-ticker.C:
+			case <-md.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (md *modelDiscovery) stop() {
+	md.stopOnce.Do(func() { close(md.stopCh) })
+}
+
+func (md *modelDiscovery) refresh() {
+	models, err := md.fetch()
+	if err != nil {
+		md.log.Warnf("Model discovery failed, serving the previous model list: %v", err)
+		return
+	}
+	md.models.Store(&models)
+	md.log.Debugf("Model discovery found %d models", gjson.GetBytes(models, "data.#").Int())
+}
+
+func (md *modelDiscovery) fetch() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(md.cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	req, err := createProxyRequest(ctx, http.MethodGet, md.cfg.ChatAPIBaseURL+"/models", nil, md.cfg.ChatAPIKey, md.cfg.ChatAPIOrganization, md.cfg.ChatAPIProject, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := md.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if !gjson.GetBytes(body, "data").IsArray() {
+		return nil, fmt.Errorf("response has no model list")
+	}
+	return body, nil
+}
+
+// cached returns the last discovered model list, or nil if none was fetched yet.
+func (md *modelDiscovery) cached() []byte {
+	if models := md.models.Load(); models != nil {
+		return *models
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestModelDiscovery(t *testing.T) {
+	const discovered = `{"object":"list","data":[{"id":"discovered-model","object":"model"}]}`
+	var healthy atomic.Bool
+	tp := newTestProxy(t, &ServiceConfig{DiscoverModels: true}, func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() || r.URL.Path != "/models" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		respondJSON(http.StatusOK, discovered)(w, r)
+	})
+
+	steps := []struct {
+		name    string
+		healthy bool
+		want    string
+	}{
+		{name: "static list before any discovery", want: "gpt-3.5-turbo"},
+		{name: "discovered list", healthy: true, want: "discovered-model"},
+		{name: "last good list kept on failure", want: "discovered-model"},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			healthy.Store(step.healthy)
+			tp.discovery.refresh()
+
+			w := tp.do(http.MethodGet, "/v1/models", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := gjson.Get(w.Body.String(), "data.0.id").String(); got != step.want {
+				t.Errorf("first model = %s, want %s", got, step.want)
+			}
+		})
+	}
+}
+
+func TestModelDiscoveryFetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{name: "model list", handler: respondJSON(http.StatusOK, `{"data":[{"id":"m"}]}`)},
+		{name: "error status", handler: respondJSON(http.StatusUnauthorized, `{"error":"bad key"}`), wantErr: true},
+		{name: "not a model list", handler: respondJSON(http.StatusOK, `{"models":"m"}`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, &ServiceConfig{}, tt.handler)
+			md := newModelDiscovery(http.DefaultClient, tp.cfg, tp.log)
+
+			_, err := md.fetch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			md.refresh()
+			if got := md.cached() != nil; got == tt.wantErr {
+				t.Errorf("cached list = %v, want %v", got, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModelsFileServed(t *testing.T) {
+	t.Parallel()
+	modelsFile := filepath.Join(t.TempDir(), "models.json")
+	if err := os.WriteFile(modelsFile, []byte(`{"object":"list","data":[{"id":"local-model"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{name: "static list", want: "gpt-3.5-turbo"},
+		{name: "models file", file: modelsFile, want: "local-model"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ModelsFile: tt.file}, respondJSON(http.StatusOK, `{}`))
+
+			w := tp.do(http.MethodGet, "/v1/models", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := gjson.Get(w.Body.String(), "data.0.id").String(); got != tt.want {
+				t.Errorf("first model = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/tidwall/sjson"
+)
+
+// hashRequestBody returns a stable hex digest of a request body, shared by every feature
+// keyed on the body. The HashExcludeFields are dropped first, so volatile fields such as
+// `user` do not change the digest, and HashAlgorithm picks the digest.
+func (s *ProxyService) hashRequestBody(body []byte) string {
+	for _, field := range s.cfg.HashExcludeFields {
+		if trimmed, err := sjson.DeleteBytes(body, field); err == nil {
+			body = trimmed
+		}
+	}
+
+	if s.cfg.HashAlgorithm == HashAlgorithmXXHash {
+		return fmt.Sprintf("%016x", xxhash.Sum64(body))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
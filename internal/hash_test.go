@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHashRequestBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *ServiceConfig
+		a, b      string
+		wantEqual bool
+		wantLen   int
+	}{
+		{name: "same body", cfg: &ServiceConfig{}, a: `{"prompt":"x"}`, b: `{"prompt":"x"}`, wantEqual: true, wantLen: 64},
+		{name: "different body", cfg: &ServiceConfig{}, a: `{"prompt":"x"}`, b: `{"prompt":"y"}`, wantLen: 64},
+		{
+			name:    "xxhash digest",
+			cfg:     &ServiceConfig{HashAlgorithm: HashAlgorithmXXHash},
+			a:       `{"prompt":"x"}`,
+			b:       `{"prompt":"y"}`,
+			wantLen: 16,
+		},
+		{
+			name:      "excluded fields ignored",
+			cfg:       &ServiceConfig{HashExcludeFields: []string{"user", "metadata.trace"}},
+			a:         `{"prompt":"x","user":"a","metadata":{"trace":"1"}}`,
+			b:         `{"prompt":"x","user":"b","metadata":{"trace":"2"}}`,
+			wantEqual: true,
+			wantLen:   64,
+		},
+		{
+			name:    "other fields still count",
+			cfg:     &ServiceConfig{HashExcludeFields: []string{"user"}},
+			a:       `{"prompt":"x","user":"a"}`,
+			b:       `{"prompt":"y","user":"a"}`,
+			wantLen: 64,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, tt.cfg)
+			a, b := s.hashRequestBody([]byte(tt.a)), s.hashRequestBody([]byte(tt.b))
+			if (a == b) != tt.wantEqual {
+				t.Errorf("hashes %s and %s, want equal = %v", a, b, tt.wantEqual)
+			}
+			if len(a) != tt.wantLen {
+				t.Errorf("hash %s has %d characters, want %d", a, len(a), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "disabled"},
+		{name: "stable across retries", enabled: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var calls atomic.Int32
+			keys := make(chan string, 2)
+			tp := newTestProxy(t, &ServiceConfig{ForwardIdempotencyKey: tt.enabled}, func(w http.ResponseWriter, r *http.Request) {
+				keys <- r.Header.Get("Idempotency-Key")
+				if calls.Add(1) == 1 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				respondJSON(http.StatusOK, `{"choices":[{"text":"ok"}]}`)(w, r)
+			})
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"x"}`, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := tp.upstreamCalls(); got != 2 {
+				t.Fatalf("upstream calls = %d, want 2", got)
+			}
+
+			first, retried := <-keys, <-keys
+			if tt.enabled && first == "" {
+				t.Error("Idempotency-Key missing")
+			}
+			if !tt.enabled && first != "" {
+				t.Errorf("Idempotency-Key = %q, want none", first)
+			}
+			if first != retried {
+				t.Errorf("retried Idempotency-Key = %q, want %q", retried, first)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	rl "github.com/shengyanli1982/orbit-contrib/pkg/ratelimiter"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestService returns a ProxyService with cfg and a no-op logger, enough for the body
+// and response transforms that do not touch the network.
+func newTestService(t *testing.T, cfg *ServiceConfig) *ProxyService {
+	t.Helper()
+	logger := zap.NewNop().Sugar()
+	return &ProxyService{
+		cfg:     cfg,
+		log:     logger,
+		retryCb: &retryCallback{logger: logger},
+		errLog:  newErrorThrottle(logger, 0),
+		metrics: newProxyMetrics(""),
+	}
+}
+
+// newDefaultTestService is newTestService with the defaults of cfg applied first.
+func newDefaultTestService(t *testing.T, cfg *ServiceConfig) *ProxyService {
+	t.Helper()
+	if err := cfg.LoadDefaults(); err != nil {
+		t.Fatalf("LoadDefaults() error = %v", err)
+	}
+	return newTestService(t, cfg)
+}
+
+// testProxy is a ProxyService serving its routes in front of a fake upstream, which records
+// the requests it receives.
+type testProxy struct {
+	*ProxyService
+	router   *gin.Engine
+	upstream *httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+// newTestProxy starts a fake upstream answering with handler and a ProxyService configured by
+// cfg, with its defaults applied and every upstream pointing at the fake one.
+func newTestProxy(t *testing.T, cfg *ServiceConfig, handler http.HandlerFunc) *testProxy {
+	t.Helper()
+
+	tp := &testProxy{}
+	tp.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		tp.mu.Lock()
+		tp.requests = append(tp.requests, r)
+		tp.bodies = append(tp.bodies, body)
+		tp.mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler(w, r)
+	}))
+	t.Cleanup(tp.upstream.Close)
+
+	cfg.CodexAPIBaseURL = tp.upstream.URL
+	cfg.ChatAPIBaseURL = tp.upstream.URL
+	if err := cfg.LoadDefaults(); err != nil {
+		t.Fatalf("LoadDefaults() error = %v", err)
+	}
+
+	limiter := rl.NewRateLimiter(rl.NewConfig().WithRate(1000).WithBurst(1000))
+	ps, err := NewProxyService(cfg, zap.NewNop().Sugar(), limiter)
+	if err != nil {
+		t.Fatalf("NewProxyService() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ps.Stop()
+		limiter.Stop()
+	})
+
+	tp.ProxyService = ps
+	tp.router = gin.New()
+	ps.RegisterGroup(tp.router.Group("/"))
+	return tp
+}
+
+// do sends a request to the proxy and returns the recorded response.
+func (tp *testProxy) do(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	tp.router.ServeHTTP(w, req)
+	return w
+}
+
+// upstreamCalls returns the number of requests the fake upstream received.
+func (tp *testProxy) upstreamCalls() int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return len(tp.requests)
+}
+
+// lastUpstream returns the last request received by the fake upstream and its body.
+func (tp *testProxy) lastUpstream(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.requests) == 0 {
+		t.Fatal("upstream received no request")
+	}
+	return tp.requests[len(tp.requests)-1], tp.bodies[len(tp.bodies)-1]
+}
+
+// respondJSON returns an upstream handler answering every request with status and body.
+func respondJSON(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// respondEvents returns an upstream handler streaming every payload as a `data:` event,
+// followed by [DONE] unless truncated is set.
+func respondEvents(payloads []string, truncated bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, payload := range payloads {
+			io.WriteString(w, "data: "+payload+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+		if !truncated {
+			io.WriteString(w, "data: [DONE]\n\n")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+var defaultChatPromptTemplates = map[string]string{
+	"system":    "System: {content}\n",
+	"user":      "User: {content}\n",
+	"assistant": "Assistant: {content}\n",
+}
+
+const DefaultChatPromptSuffix = "Assistant:"
+
+// convertChatToCompletions flattens the chat messages into a single completions prompt,
+// rendering every message with the template configured for its role.
+func (s *ProxyService) convertChatToCompletions(body []byte) ([]byte, error) {
+	var prompt strings.Builder
+	for _, msg := range gjson.GetBytes(body, "messages").Array() {
+		role := msg.Get("role").String()
+		template, ok := s.cfg.ChatPromptTemplates[role]
+		if !ok {
+			template = "{content}\n"
+		}
+		prompt.WriteString(strings.ReplaceAll(template, "{content}", msg.Get("content").String()))
+	}
+	prompt.WriteString(s.cfg.ChatPromptSuffix)
+
+	body, err := s.setJSONField(body, "prompt", prompt.String())
+	if err != nil {
+		return nil, err
+	}
+	return s.deleteFields(body, []string{"messages", "tools", "tool_choice", "functions", "function_call", "response_format"})
+}
+
+type chatChoice struct {
+	Index        int64           `json:"index"`
+	Message      *chatMessage    `json:"message,omitempty"`
+	Delta        *chatMessage    `json:"delta,omitempty"`
+	FinishReason json.RawMessage `json:"finish_reason"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type chatCompletion struct {
+	ID      string          `json:"id,omitempty"`
+	Object  string          `json:"object"`
+	Created int64           `json:"created"`
+	Model   string          `json:"model"`
+	Choices []chatChoice    `json:"choices"`
+	Usage   json.RawMessage `json:"usage,omitempty"`
+}
+
+// wrapCompletion converts a completions response or chunk into the chat completion shape.
+func wrapCompletion(body []byte, object string, stream, withRole bool) ([]byte, error) {
+	result := gjson.ParseBytes(body)
+	chat := chatCompletion{
+		ID:      result.Get("id").String(),
+		Object:  object,
+		Created: result.Get("created").Int(),
+		Model:   result.Get("model").String(),
+		Choices: make([]chatChoice, 0),
+	}
+	if usage := result.Get("usage"); usage.Exists() {
+		chat.Usage = json.RawMessage(usage.Raw)
+	}
+
+	for _, item := range result.Get("choices").Array() {
+		choice := chatChoice{Index: item.Get("index").Int(), FinishReason: json.RawMessage("null")}
+		if finishReason := item.Get("finish_reason"); finishReason.Exists() {
+			choice.FinishReason = json.RawMessage(finishReason.Raw)
+		}
+		message := &chatMessage{Content: item.Get("text").String()}
+		if stream {
+			if withRole {
+				message.Role = "assistant"
+			}
+			choice.Delta = message
+		} else {
+			message.Role = "assistant"
+			choice.Message = message
+		}
+		chat.Choices = append(chat.Choices, choice)
+	}
+
+	return json.Marshal(chat)
+}
+
+func wrapCompletionAsChat(body []byte) ([]byte, error) {
+	return wrapCompletion(body, "chat.completion", false, false)
+}
+
+// newCompletionChunkWrapper converts streamed completion chunks into chat completion
+// chunks, the first chunk carries the assistant role.
+func newCompletionChunkWrapper() frameTransform {
+	first := true
+	return func(payload []byte) ([]byte, error) {
+		wrapped, err := wrapCompletion(payload, "chat.completion.chunk", true, first)
+		first = false
+		return wrapped, err
+	}
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestConvertChatToCompletions(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates map[string]string
+		body      string
+		want      string
+	}{
+		{
+			name: "default templates",
+			body: `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello"},{"role":"user","content":"Bye"}]}`,
+			want: "System: Be brief.\nUser: Hi\nAssistant: Hello\nUser: Bye\nAssistant:",
+		},
+		{
+			name:      "custom user template",
+			templates: map[string]string{"user": "### Question\n{content}\n"},
+			body:      `{"messages":[{"role":"user","content":"Hi"}]}`,
+			want:      "### Question\nHi\nAssistant:",
+		},
+		{
+			name: "unknown role",
+			body: `{"messages":[{"role":"developer","content":"Hi"}]}`,
+			want: "Hi\nAssistant:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, &ServiceConfig{ChatPromptTemplates: tt.templates})
+			out, err := s.convertChatToCompletions([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("convertChatToCompletions() error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "prompt").String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+			if gjson.GetBytes(out, "messages").Exists() {
+				t.Errorf("messages kept: %s", out)
+			}
+		})
+	}
+}
+
+func TestWrapCompletion(t *testing.T) {
+	completion := `{"id":"cmpl-1","created":1700000000,"model":"m","choices":[{"index":0,"text":"Hello","finish_reason":"stop"}],"usage":{"total_tokens":3}}`
+	tests := []struct {
+		name       string
+		wrap       func([]byte) ([]byte, error)
+		wantObject string
+		wantPath   string
+		wantRole   string
+	}{
+		{
+			name:       "response",
+			wrap:       wrapCompletionAsChat,
+			wantObject: "chat.completion",
+			wantPath:   "choices.0.message",
+			wantRole:   "assistant",
+		},
+		{
+			name:       "first chunk",
+			wrap:       newCompletionChunkWrapper(),
+			wantObject: "chat.completion.chunk",
+			wantPath:   "choices.0.delta",
+			wantRole:   "assistant",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tt.wrap([]byte(completion))
+			if err != nil {
+				t.Fatalf("wrap error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "object").String(); got != tt.wantObject {
+				t.Errorf("object = %s, want %s", got, tt.wantObject)
+			}
+			if got := gjson.GetBytes(out, tt.wantPath+".content").String(); got != "Hello" {
+				t.Errorf("content = %q, want %q", got, "Hello")
+			}
+			if got := gjson.GetBytes(out, tt.wantPath+".role").String(); got != tt.wantRole {
+				t.Errorf("role = %q, want %q", got, tt.wantRole)
+			}
+			for _, path := range []string{"id", "model", "choices.0.finish_reason", "usage.total_tokens"} {
+				if gjson.GetBytes(out, path).String() != gjson.Get(completion, path).String() {
+					t.Errorf("%s = %s, want %s", path, gjson.GetBytes(out, path), gjson.Get(completion, path))
+				}
+			}
+		})
+	}
+
+	// Only the first chunk carries the role
+	wrap := newCompletionChunkWrapper()
+	wrap([]byte(completion))
+	out, err := wrap([]byte(completion))
+	if err != nil {
+		t.Fatalf("wrap error = %v", err)
+	}
+	if gjson.GetBytes(out, "choices.0.delta.role").Exists() {
+		t.Errorf("second chunk has a role: %s", out)
+	}
+}
+
+func TestChatToCompletionsProxy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		body    string
+		handler http.HandlerFunc
+		want    []string
+	}{
+		{
+			name:    "response",
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			handler: respondJSON(http.StatusOK, `{"id":"cmpl-1","choices":[{"index":0,"text":"Hello","finish_reason":"stop"}]}`),
+			want:    []string{`"object":"chat.completion"`, `"message":{"role":"assistant","content":"Hello"}`},
+		},
+		{
+			name: "stream",
+			body: `{"messages":[{"role":"user","content":"Hi"}],"stream":true}`,
+			handler: respondEvents([]string{
+				`{"id":"cmpl-1","choices":[{"index":0,"text":"Hel","finish_reason":null}]}`,
+				`{"id":"cmpl-1","choices":[{"index":0,"text":"lo","finish_reason":"stop"}]}`,
+			}, false),
+			want: []string{
+				`"delta":{"role":"assistant","content":"Hel"}`,
+				`"delta":{"content":"lo"}`,
+				"data: [DONE]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ChatToCompletions: true, DisableLocale: true}, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/chat/completions", tt.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			req, upstreamBody := tp.lastUpstream(t)
+			if req.URL.Path != "/completions" {
+				t.Errorf("upstream path = %s, want /completions", req.URL.Path)
+			}
+			if got := gjson.GetBytes(upstreamBody, "prompt").String(); got != "User: Hi\nAssistant:" {
+				t.Errorf("upstream prompt = %q", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body = %s, want %s", w.Body.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"unicode"
+
+	"github.com/tidwall/gjson"
+)
+
+// Languages reported by detectLanguage, used as keys of the auto locale map.
+const (
+	LanguageChinese  = "zh"
+	LanguageJapanese = "ja"
+	LanguageKorean   = "ko"
+	LanguageRussian  = "ru"
+	LanguageEnglish  = "en"
+)
+
+var defaultAutoLocaleMap = map[string]string{
+	LanguageChinese:  "zh_CN",
+	LanguageJapanese: "ja_JP",
+	LanguageKorean:   "ko_KR",
+	LanguageRussian:  "ru_RU",
+	LanguageEnglish:  "en_US",
+}
+
+// detectLanguage guesses the dominant language of text from the scripts of its letters.
+// It returns an empty string when text has no letters.
+func detectLanguage(text string) string {
+	var han, kana, hangul, cyrillic, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	// Japanese text mixes kana with Han characters
+	if kana > 0 && kana+han >= hangul && kana+han >= cyrillic && kana+han >= latin {
+		return LanguageJapanese
+	}
+
+	language, best := "", 0
+	for _, candidate := range []struct {
+		language string
+		count    int
+	}{
+		{LanguageChinese, han},
+		{LanguageKorean, hangul},
+		{LanguageRussian, cyrillic},
+		{LanguageEnglish, latin},
+	} {
+		if candidate.count > best {
+			language, best = candidate.language, candidate.count
+		}
+	}
+	return language
+}
+
+// detectLocale picks the locale matching the language of the last user message, or an
+// empty string when the language is unknown or not mapped.
+func (s *ProxyService) detectLocale(messages []gjson.Result) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Get("role").String() == "user" {
+			return s.cfg.AutoLocaleMap[detectLanguage(messages[i].Get("content").String())]
+		}
+	}
+	return ""
+}
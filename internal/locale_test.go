@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "chinese", text: "请解释这段代码的作用", want: LanguageChinese},
+		{name: "japanese", text: "このコードを説明してください", want: LanguageJapanese},
+		{name: "korean", text: "이 코드를 설명해 주세요", want: LanguageKorean},
+		{name: "russian", text: "Объясни этот код", want: LanguageRussian},
+		{name: "english", text: "Explain this code", want: LanguageEnglish},
+		{name: "chinese with identifiers", text: "为什么 fooBar 返回空值？", want: LanguageChinese},
+		{name: "no letters", text: "1 + 2 == 3", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLanguage(tt.text); got != tt.want {
+				t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoLocale(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ServiceConfig
+		body string
+		want string
+	}{
+		{
+			name: "disabled uses the chat locale",
+			cfg:  &ServiceConfig{ChatLocale: "fr_FR"},
+			body: `{"messages":[{"role":"user","content":"Объясни этот код"}]}`,
+			want: "fr_FR",
+		},
+		{
+			name: "russian detected",
+			cfg:  &ServiceConfig{ChatLocale: "fr_FR", AutoLocale: true},
+			body: `{"messages":[{"role":"user","content":"Объясни этот код"}]}`,
+			want: "ru_RU",
+		},
+		{
+			name: "last user message wins",
+			cfg:  &ServiceConfig{ChatLocale: "fr_FR", AutoLocale: true},
+			body: `{"messages":[{"role":"user","content":"请解释"},{"role":"assistant","content":"..."},{"role":"user","content":"このコードを説明して"}]}`,
+			want: "ja_JP",
+		},
+		{
+			name: "custom locale map",
+			cfg:  &ServiceConfig{ChatLocale: "fr_FR", AutoLocale: true, AutoLocaleMap: map[string]string{LanguageEnglish: "en_GB"}},
+			body: `{"messages":[{"role":"user","content":"Explain this code"}]}`,
+			want: "en_GB",
+		},
+		{
+			name: "unknown language falls back to the chat locale",
+			cfg:  &ServiceConfig{ChatLocale: "fr_FR", AutoLocale: true},
+			body: `{"messages":[{"role":"user","content":"1 + 2 == 3"}]}`,
+			want: "fr_FR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newDefaultTestService(t, tt.cfg).setLocaleIfNeeded([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("setLocaleIfNeeded() error = %v", err)
+			}
+			messages := gjson.GetBytes(out, "messages").Array()
+			content := messages[len(messages)-1].Get("content").String()
+			if !strings.HasSuffix(content, "Respond in the following locale: "+tt.want+".") {
+				t.Errorf("content = %q, want locale %s", content, tt.want)
+			}
+		})
+	}
+}
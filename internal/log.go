@@ -60,8 +60,12 @@ func (cl *Logger) GetZapSugaredLogger() *zap.SugaredLogger {
 }
 
 func NewLumberjackLogger(path string) *lumberjack.Logger {
+	return newRotatingFile(fmt.Sprintf("%s/console.log", path))
+}
+
+func newRotatingFile(filename string) *lumberjack.Logger {
 	return &lumberjack.Logger{
-		Filename:   fmt.Sprintf("%s/console.log", path),
+		Filename:   filename,
 		MaxSize:    500,   // 每个日志文件最大500MB
 		MaxBackups: 10,    // 最多保留10个备份
 		MaxAge:     30,    // 最多保留30天
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HeaderModel      = "X-Model"
+	HeaderRoute      = "X-Route"
+	HeaderTokenLabel = "X-Token-Label"
+	HeaderRequestID  = "X-Request-Id"
+
+	HeaderLdorModel          = "X-Ldor-Model"
+	HeaderLdorRequestedModel = "X-Ldor-Requested-Model"
+	HeaderUpstreamRequestID  = "X-Upstream-Request-ID"
+)
+
+// setMetadataHeaders adds the computed per-request headers used by observability gateways
+// to the upstream request. The client's X-Request-Id is reused when present.
+func (s *ProxyService) setMetadataHeaders(c *gin.Context, req *http.Request) {
+	if !s.cfg.InjectMetadataHeaders {
+		return
+	}
+
+	if model := c.GetString(ContextKeyModel); model != "" {
+		req.Header.Set(HeaderModel, model)
+	}
+	if route := c.FullPath(); route != "" {
+		req.Header.Set(HeaderRoute, route)
+	}
+	if s.cfg.TokenLabel != "" {
+		req.Header.Set(HeaderTokenLabel, s.cfg.TokenLabel)
+	}
+
+	requestID := c.GetHeader(HeaderRequestID)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	req.Header.Set(HeaderRequestID, requestID)
+}
+
+// newRequestID returns a random 128-bit hex request id.
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMetadataHeaders(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		cfg       *ServiceConfig
+		requestID string
+		want      map[string]string
+	}{
+		{
+			name: "disabled",
+			cfg:  &ServiceConfig{TokenLabel: "team-a"},
+			want: map[string]string{HeaderModel: "", HeaderRoute: "", HeaderTokenLabel: "", HeaderRequestID: ""},
+		},
+		{
+			name:      "client request id reused",
+			cfg:       &ServiceConfig{InjectMetadataHeaders: true, TokenLabel: "team-a"},
+			requestID: "req-42",
+			want: map[string]string{
+				HeaderModel:      "gpt-4",
+				HeaderRoute:      "/v1/chat/completions",
+				HeaderTokenLabel: "team-a",
+				HeaderRequestID:  "req-42",
+			},
+		},
+		{
+			name: "without token label",
+			cfg:  &ServiceConfig{InjectMetadataHeaders: true},
+			want: map[string]string{HeaderModel: "gpt-4", HeaderTokenLabel: ""},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.cfg.DisableModelMapping = true
+			tp := newTestProxy(t, tt.cfg, respondJSON(http.StatusOK, `{"choices":[{"message":{"content":"a"}}]}`))
+
+			header := http.Header{}
+			if tt.requestID != "" {
+				header.Set(HeaderRequestID, tt.requestID)
+			}
+			w := tp.do(http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`, header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			req, _ := tp.lastUpstream(t)
+			for name, want := range tt.want {
+				if got := req.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.cfg.InjectMetadataHeaders && tt.requestID == "" && len(req.Header.Get(HeaderRequestID)) != 32 {
+				t.Errorf("%s = %q, want a generated id", HeaderRequestID, req.Header.Get(HeaderRequestID))
+			}
+		})
+	}
+}
+
+func TestExposeModelHeader(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		expose        bool
+		body          string
+		status        int
+		wantModel     string
+		wantRequested string
+	}{
+		{name: "disabled", body: `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`, status: http.StatusOK},
+		{
+			name:          "mapped model",
+			expose:        true,
+			body:          `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`,
+			status:        http.StatusOK,
+			wantModel:     "gpt-4o-mini",
+			wantRequested: "fast",
+		},
+		{
+			name:      "no requested model",
+			expose:    true,
+			body:      `{"messages":[{"role":"user","content":"hi"}]}`,
+			status:    http.StatusOK,
+			wantModel: "gpt-4",
+		},
+		{
+			name:          "upstream error",
+			expose:        true,
+			body:          `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`,
+			status:        http.StatusBadRequest,
+			wantModel:     "gpt-4o-mini",
+			wantRequested: "fast",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{
+				ExposeModelHeader: tt.expose,
+				ChatModelMapping:  map[string]string{"fast": "gpt-4o-mini"},
+				ChatDefaultModel:  "gpt-4",
+			}
+			tp := newTestProxy(t, cfg, respondJSON(tt.status, `{"choices":[{"message":{"content":"a"}}]}`))
+
+			w := tp.do(http.MethodPost, "/v1/chat/completions", tt.body, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get(HeaderLdorModel); got != tt.wantModel {
+				t.Errorf("%s = %q, want %q", HeaderLdorModel, got, tt.wantModel)
+			}
+			if got := w.Header().Get(HeaderLdorRequestedModel); got != tt.wantRequested {
+				t.Errorf("%s = %q, want %q", HeaderLdorRequestedModel, got, tt.wantRequested)
+			}
+		})
+	}
+}
+
+func TestForwardUpstreamID(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		forward bool
+		header  string
+		status  int
+		want    string
+	}{
+		{name: "disabled", status: http.StatusOK},
+		{name: "default header", forward: true, status: http.StatusOK, want: "req-default"},
+		{name: "custom header", forward: true, header: "Apim-Request-Id", status: http.StatusOK, want: "req-custom"},
+		{name: "upstream error", forward: true, status: http.StatusBadRequest, want: "req-default"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{ForwardUpstreamID: tt.forward, UpstreamIDHeader: tt.header}
+			tp := newTestProxy(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(HeaderRequestID, "req-default")
+				w.Header().Set("Apim-Request-Id", "req-custom")
+				respondJSON(tt.status, `{"choices":[{"text":"a"}]}`)(w, r)
+			})
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get(HeaderUpstreamRequestID); got != tt.want {
+				t.Errorf("%s = %q, want %q", HeaderUpstreamRequestID, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "ldor"
+
+type proxyMetrics struct {
+	streamFirstByte  *prometheus.HistogramVec
+	streamChunkGap   *prometheus.HistogramVec
+	streamQueueDepth prometheus.Gauge
+}
+
+// newProxyMetrics creates the proxy metrics, labeled with environment when it is set.
+func newProxyMetrics(environment string) *proxyMetrics {
+	var constLabels prometheus.Labels
+	if environment != "" {
+		constLabels = prometheus.Labels{"environment": environment}
+	}
+
+	return &proxyMetrics{
+		streamFirstByte: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "stream_first_byte_seconds",
+			Help:        "Time from sending the upstream request to the first streamed byte.",
+			Buckets:     []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+			ConstLabels: constLabels,
+		}, []string{"model"}),
+		streamChunkGap: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "stream_chunk_gap_seconds",
+			Help:        "Time between two consecutive flushes of a streamed response.",
+			Buckets:     []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+			ConstLabels: constLabels,
+		}, []string{"model"}),
+		streamQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "stream_queue_depth",
+			Help:        "Number of streaming requests waiting for a stream slot.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// register adds the metrics to registerer, metrics already registered are reused.
+func (pm *proxyMetrics) register(registerer prometheus.Registerer) error {
+	for _, collector := range []**prometheus.HistogramVec{&pm.streamFirstByte, &pm.streamChunkGap} {
+		existing, err := registerCollector(registerer, *collector)
+		if err != nil {
+			return err
+		}
+		*collector = existing.(*prometheus.HistogramVec)
+	}
+
+	existing, err := registerCollector(registerer, pm.streamQueueDepth)
+	if err != nil {
+		return err
+	}
+	pm.streamQueueDepth = existing.(prometheus.Gauge)
+	return nil
+}
+
+// registerCollector registers collector and returns it, or the collector registered before it.
+func registerCollector(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := registerer.Register(collector); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		return are.ExistingCollector, nil
+	}
+	return collector, nil
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProxyMetricsEnvironmentLabel(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment string
+	}{
+		{name: "unlabeled"},
+		{name: "labeled", environment: "staging"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			pm := newProxyMetrics(tt.environment)
+			if err := pm.register(registry); err != nil {
+				t.Fatalf("register() error = %v", err)
+			}
+			pm.streamFirstByte.WithLabelValues("m").Observe(1)
+			pm.streamChunkGap.WithLabelValues("m").Observe(1)
+			pm.streamQueueDepth.Set(1)
+
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Gather() error = %v", err)
+			}
+			if len(families) != 3 {
+				t.Fatalf("metric families = %d, want 3", len(families))
+			}
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					got := ""
+					for _, label := range metric.GetLabel() {
+						if label.GetName() == "environment" {
+							got = label.GetValue()
+						}
+					}
+					if got != tt.environment {
+						t.Errorf("%s environment = %q, want %q", family.GetName(), got, tt.environment)
+					}
+				}
+			}
+		})
+	}
+}
@@ -3,15 +3,21 @@ package internal
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	rl "github.com/shengyanli1982/orbit-contrib/pkg/ratelimiter"
 	"github.com/shengyanli1982/retry"
 	"github.com/tidwall/gjson"
@@ -25,6 +31,23 @@ const (
 	DeepSeekCoderModel = "deepseek-coder"
 )
 
+const (
+	ContextKeyModel          = "ldor.model"
+	ContextKeyUpstreamStart  = "ldor.upstream_start"
+	ContextKeyLimiterPassed  = "ldor.limiter_passed"
+	ContextKeyStream         = "ldor.stream"
+	ContextKeyRequestedModel = "ldor.requested_model"
+	ContextKeyTiming         = "ldor.timing"
+)
+
+const (
+	RequestTypeCodex = "completions"
+	RequestTypeChat  = "chat completions"
+
+	RequestTypeChatToCompletions = "chat to completions"
+	RequestTypeModerations       = "moderations"
+)
+
 var ErrorConfigureTransport = errors.New("config transport failed")
 
 type retryCallback struct {
@@ -42,11 +65,24 @@ type Pong struct {
 }
 
 type ProxyService struct {
-	limiter *rl.RateLimiter
-	log     *zap.SugaredLogger
-	cfg     *ServiceConfig
-	client  *http.Client
-	retrier *retry.Retry
+	limiter      *rl.RateLimiter
+	chatLimiter  *rl.RateLimiter
+	codexLimiter *rl.RateLimiter
+	log          *zap.SugaredLogger
+	cfg          *ServiceConfig
+	client       *http.Client
+	hookClient   *http.Client
+	retryCb      *retryCallback
+	metrics      *proxyMetrics
+	ready        atomic.Bool
+	routes       []string
+	debug        bool
+	deadLetter   *deadLetterLog
+	streamSlots  chan struct{}
+	streamQueued atomic.Int32
+	discovery    *modelDiscovery
+	errLog       *errorThrottle
+	statusHist   *statusHistogram
 }
 
 func NewProxyService(config *ServiceConfig, logger *zap.SugaredLogger, limiter *rl.RateLimiter) (*ProxyService, error) {
@@ -55,44 +91,225 @@ func NewProxyService(config *ServiceConfig, logger *zap.SugaredLogger, limiter *
 		return nil, err
 	}
 
-	retryCfg := retry.NewConfig().WithCallback(&retryCallback{logger: logger}).WithInitDelay(500 * time.Millisecond)
+	if err := checkCredentials(httpClient, config, logger); err != nil {
+		return nil, err
+	}
+
+	metrics := newProxyMetrics(config.Environment)
+	if err := metrics.register(prometheus.DefaultRegisterer); err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+
+	var streamSlots chan struct{}
+	if config.MaxConcurrentStreams > 0 {
+		streamSlots = make(chan struct{}, config.MaxConcurrentStreams)
+	}
+
+	var statusHist *statusHistogram
+	if config.StatusHistogram {
+		statusHist = newStatusHistogram(config.StatusHistogramMin)
+	}
+
+	if config.CaptureDir != "" {
+		if err := os.MkdirAll(config.CaptureDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create capture directory: %w", err)
+		}
+	}
+
+	var discovery *modelDiscovery
+	if config.DiscoverModels {
+		discovery = newModelDiscovery(httpClient, config, logger)
+		discovery.start()
+	}
+
+	// The transform webhook gets its own client, bound by the webhook timeout
+	var hookClient *http.Client
+	if config.WebhookURL != "" {
+		if hookClient, err = createHTTPClient(config); err != nil {
+			return nil, err
+		}
+		hookClient.Timeout = time.Duration(config.WebhookTimeoutMs) * time.Millisecond
+	}
+
+	var deadLetter *deadLetterLog
+	if config.DeadLetterFile != "" {
+		deadLetter = newDeadLetterLog(config.DeadLetterFile)
+	}
+
+	errLog := newErrorThrottle(logger, time.Duration(config.LogDedupWindowMs)*time.Millisecond)
+	errLog.start()
 
 	return &ProxyService{
-		log:     logger,
-		limiter: limiter,
-		cfg:     config,
-		client:  httpClient,
-		retrier: retry.New(retryCfg),
+		log:          logger,
+		limiter:      limiter,
+		chatLimiter:  newRouteLimiter(config.ChatRequestsPerSec, limiter),
+		codexLimiter: newRouteLimiter(config.CodexRequestsPerSec, limiter),
+		cfg:          config,
+		client:       httpClient,
+		hookClient:   hookClient,
+		retryCb:      &retryCallback{logger: logger},
+		metrics:      metrics,
+		deadLetter:   deadLetter,
+		streamSlots:  streamSlots,
+		discovery:    discovery,
+		errLog:       errLog,
+		statusHist:   statusHist,
 	}, nil
 }
 
+// newRouteLimiter creates a dedicated limiter for a route, or falls back to the global one.
+func newRouteLimiter(requestsPerSecond int, global *rl.RateLimiter) *rl.RateLimiter {
+	if requestsPerSecond <= 0 {
+		return global
+	}
+	return rl.NewRateLimiter(rl.NewConfig().WithRate(float64(requestsPerSecond)).WithBurst(1))
+}
+
+// SetDebugMode enables the debug-only logging of the service, such as upstream headers.
+func (ps *ProxyService) SetDebugMode(debug bool) {
+	ps.debug = debug
+}
+
+func (ps *ProxyService) debugHeaders() bool {
+	return ps.debug && ps.cfg.DebugHeaders
+}
+
+// Drain marks the service as not ready and waits PreShutdownDelayMs while still serving,
+// so load balancers can stop routing traffic before the server shuts down.
+func (ps *ProxyService) Drain() {
+	ps.ready.Store(false)
+	if ps.cfg.PreShutdownDelayMs > 0 {
+		ps.log.Infof("Service is draining, shutdown in %dms", ps.cfg.PreShutdownDelayMs)
+		time.Sleep(time.Duration(ps.cfg.PreShutdownDelayMs) * time.Millisecond)
+	}
+}
+
+// Stop releases the route limiters, the dead-letter log and the model discovery owned by the service.
+func (ps *ProxyService) Stop() {
+	if ps.chatLimiter != ps.limiter {
+		ps.chatLimiter.Stop()
+	}
+	if ps.codexLimiter != ps.limiter {
+		ps.codexLimiter.Stop()
+	}
+	if ps.deadLetter != nil {
+		_ = ps.deadLetter.Close()
+	}
+	if ps.discovery != nil {
+		ps.discovery.stop()
+	}
+	ps.errLog.stop()
+}
+
 func (ps *ProxyService) RegisterGroup(g *gin.RouterGroup) {
 	// Common routes
-	g.GET("/_ping", ps.handlePing)
-	g.GET("/models", ps.getAvailableModels)
-	g.GET("/v1/models", ps.getAvailableModels)
+	ps.handle(g, http.MethodGet, "/_ping", ps.handlePing)
+	ps.handle(g, http.MethodGet, "/readyz", ps.handleReady)
+	ps.handle(g, http.MethodGet, "/models", ps.getAvailableModels)
+	ps.handle(g, http.MethodGet, "/v1/models", ps.getAvailableModels)
 
 	// Chat and code completion routes
 	chatRoute := "/chat/completions"
 	codeRoute := "/engines/copilot-codex/completions"
 
+	var v1, admin *gin.RouterGroup
 	if ps.cfg.AuthToken != "" {
 		// Authenticated routes
-		v1 := g.Group("/:token/v1", AuthMiddleware(ps.cfg.AuthToken))
-		v1.POST(chatRoute, ps.limiter.HandlerFunc(), ps.handleChatCompletions)
-		v1.POST(codeRoute, ps.limiter.HandlerFunc(), ps.handleCodeCompletions)
-		v1.POST("/v1"+chatRoute, ps.limiter.HandlerFunc(), ps.handleChatCompletions)
-		v1.POST("/v1"+codeRoute, ps.limiter.HandlerFunc(), ps.handleCodeCompletions)
+		v1 = g.Group("/:token/v1", AuthMiddleware(ps.cfg.AuthToken, ps.cfg.AuthQuietReject, ps.cfg.ErrorMessages))
+		admin = g.Group("/:token/admin", AuthMiddleware(ps.cfg.AuthToken, ps.cfg.AuthQuietReject, ps.cfg.ErrorMessages))
 	} else {
 		// Unauthenticated routes
-		v1 := g.Group("/v1")
-		v1.POST(chatRoute, ps.limiter.HandlerFunc(), ps.handleChatCompletions)
-		v1.POST(codeRoute, ps.limiter.HandlerFunc(), ps.handleCodeCompletions)
-		v1.POST("/v1"+chatRoute, ps.limiter.HandlerFunc(), ps.handleChatCompletions)
-		v1.POST("/v1"+codeRoute, ps.limiter.HandlerFunc(), ps.handleCodeCompletions)
+		v1 = g.Group("/v1")
+		admin = g.Group("/admin")
+	}
+	if ps.cfg.ExposeTiming {
+		v1.Use(startTiming)
+	}
+	ps.handleVariants(v1, http.MethodPost, chatRoute, ps.withLimiter(ps.chatLimiter, ps.handleChatCompletions)...)
+	ps.handleVariants(v1, http.MethodPost, codeRoute, ps.withLimiter(ps.codexLimiter, ps.handleCodeCompletions)...)
+	if ps.cfg.EnableModerations {
+		ps.handleVariants(v1, http.MethodPost, "/moderations", ps.withLimiter(ps.chatLimiter, ps.handleModerations)...)
+	}
+	if ps.cfg.EnableWebSocket {
+		ps.handleVariants(v1, http.MethodGet, chatRoute, ps.withLimiter(ps.chatLimiter, ps.handleWebSocket(ps.handleChatCompletions))...)
+		ps.handleVariants(v1, http.MethodGet, codeRoute, ps.withLimiter(ps.codexLimiter, ps.handleWebSocket(ps.handleCodeCompletions))...)
+	}
+
+	// Admin routes
+	if ps.statusHist != nil {
+		ps.handle(admin, http.MethodGet, "/status-histogram", ps.handleStatusHistogram)
+	}
+
+	ps.ready.Store(true)
+}
+
+// withLimiter prepends the limiter middleware to handler unless rate limiting is disabled.
+func (ps *ProxyService) withLimiter(limiter *rl.RateLimiter, handler gin.HandlerFunc) []gin.HandlerFunc {
+	if !ps.cfg.RateLimitingEnabled() {
+		return []gin.HandlerFunc{handler}
+	}
+	return []gin.HandlerFunc{ps.guardLimiter(limiter.HandlerFunc()), markLimiterPassed, handler}
+}
+
+// guardLimiter recovers from a failing limiter and applies RateLimitFailMode: fail-open lets
+// the request through, fail-closed rejects it with 503. Panics raised after the limiter let
+// the request pass are not the limiter's and are re-raised.
+func (ps *ProxyService) guardLimiter(limiter gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if c.GetBool(ContextKeyLimiterPassed) {
+				panic(r)
+			}
+
+			ps.log.Errorf("Rate limiter failed, fail mode %s: %v", ps.cfg.RateLimitFailMode, r)
+			if ps.cfg.RateLimitFailMode == FailModeClosed {
+				ps.respondWithError(c, http.StatusServiceUnavailable, "Rate limiter unavailable")
+				return
+			}
+			c.Next()
+		}()
+		limiter(c)
 	}
 }
 
+func markLimiterPassed(c *gin.Context) {
+	c.Set(ContextKeyLimiterPassed, true)
+	timingFrom(c).lap("ratelimit")
+}
+
+// handleVariants registers path once for every configured path variant prefix, so clients
+// calling e.g. both /v1/chat/completions and /v1/v1/chat/completions are served.
+func (ps *ProxyService) handleVariants(g *gin.RouterGroup, method, path string, handlers ...gin.HandlerFunc) {
+	registered := make(map[string]bool, len(ps.cfg.PathVariants))
+	for _, variant := range ps.cfg.PathVariants {
+		variant = strings.TrimSuffix(variant, "/")
+		if registered[variant] {
+			continue
+		}
+		registered[variant] = true
+		ps.handle(g, method, variant+path, handlers...)
+	}
+}
+
+// handle registers a route on the group and records it for the startup summary.
+func (ps *ProxyService) handle(g *gin.RouterGroup, method, path string, handlers ...gin.HandlerFunc) {
+	g.Handle(method, path, handlers...)
+	ps.routes = append(ps.routes, method+" "+joinPaths(g.BasePath(), path))
+}
+
+// Routes returns the routes registered by the service, in registration order.
+func (ps *ProxyService) Routes() []string {
+	return ps.routes
+}
+
+func joinPaths(base, path string) string {
+	return strings.TrimSuffix(base, "/") + path
+}
+
 func (ps *ProxyService) handlePing(c *gin.Context) {
 	c.JSON(http.StatusOK, Pong{
 		Now:    time.Now().Second(),
@@ -101,70 +318,244 @@ func (ps *ProxyService) handlePing(c *gin.Context) {
 	})
 }
 
+func (ps *ProxyService) handleReady(c *gin.Context) {
+	if !ps.ready.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
 func (s *ProxyService) getAvailableModels(c *gin.Context) {
+	if s.discovery != nil {
+		if models := s.discovery.cached(); models != nil {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", models)
+			return
+		}
+	}
+	if s.cfg.modelsList != nil {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", s.cfg.modelsList)
+		return
+	}
 	c.JSON(http.StatusOK, defaultModels)
 }
 
 func (s *ProxyService) handleCodeCompletions(c *gin.Context) {
 	ctx := c.Request.Context()
 	if ctx.Err() != nil {
-		respondWithError(c, http.StatusRequestTimeout, "Request timeout")
+		s.respondWithError(c, http.StatusRequestTimeout, "Request timeout")
 		return
 	}
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		s.log.Errorf("Failed to read request body: %v", err)
-		respondWithError(c, http.StatusBadRequest, "Invalid request body")
+		s.respondWithError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	timingFrom(c).lap("read")
+	c.Set(ContextKeyRequestedModel, gjson.GetBytes(body, "model").String())
+
+	if s.cfg.ValidateRequests {
+		if violations := validateRequestBody(codeRequestSchema, body); len(violations) > 0 {
+			s.respondWithViolations(c, violations)
+			return
+		}
+	}
+
+	body = s.prepareCodeRequestBody(body, c.Request.Header)
+
+	body, err = s.reconcileAcceptStream(body, c.Request.Header)
+	if err != nil {
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to prepare code request body")
+		return
+	}
+
+	c.Set(ContextKeyModel, gjson.GetBytes(body, "model").String())
+	c.Set(ContextKeyStream, gjson.GetBytes(body, "stream").Bool())
+
+	body, err = s.applyTransformWebhook(c, body)
+	if err != nil {
+		s.respondWithError(c, http.StatusBadGateway, "Failed to transform request body")
 		return
 	}
+	timingFrom(c).lap("transform")
 
-	body = s.prepareCodeRequestBody(body)
+	release, err := s.acquireStreamSlot(ctx, body)
+	if errors.Is(err, ErrorStreamSlotsBusy) {
+		s.respondWithError(c, http.StatusServiceUnavailable, "Too many concurrent streams")
+		return
+	}
+	if err != nil {
+		// The client went away while queued, there is nobody to respond to
+		c.Abort()
+		return
+	}
+	defer release()
+	timingFrom(c).lap("queue")
 
 	proxyURL := s.cfg.CodexAPIBaseURL + "/completions"
-	req, err := createProxyRequest(ctx, http.MethodPost, proxyURL, body, s.cfg.CodexAPIKey, s.cfg.CodexAPIOrganization, s.cfg.CodexAPIProject)
+	req, err := createProxyRequest(ctx, http.MethodPost, proxyURL, body, s.upstreamAPIKey(c, s.cfg.CodexAPIKey), s.cfg.CodexAPIOrganization, s.cfg.CodexAPIProject, s.idempotencyKey(body))
 	if err != nil {
 		s.log.Errorf("Failed to create request: %v", err)
-		respondWithError(c, http.StatusInternalServerError, "Failed to create request")
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to create request")
 		return
 	}
 
-	s.handleProxyRequest(c, req, "completions")
+	s.handleProxyRequest(c, req, RequestTypeCodex)
 }
 
 func (s *ProxyService) handleChatCompletions(c *gin.Context) {
 	ctx := c.Request.Context()
 	if ctx.Err() != nil {
-		respondWithError(c, http.StatusRequestTimeout, "Request timeout")
+		s.respondWithError(c, http.StatusRequestTimeout, "Request timeout")
 		return
 	}
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		s.log.Errorf("Failed to read request body: %v", err)
-		respondWithError(c, http.StatusBadRequest, "Invalid request body")
+		s.respondWithError(c, http.StatusBadRequest, "Invalid request body")
 		return
 	}
+	timingFrom(c).lap("read")
+	c.Set(ContextKeyRequestedModel, gjson.GetBytes(body, "model").String())
+
+	if s.cfg.ValidateRequests {
+		if violations := validateRequestBody(chatRequestSchema, body); len(violations) > 0 {
+			s.respondWithViolations(c, violations)
+			return
+		}
+	}
 
-	body, err = s.prepareChatRequestBody(body)
+	body, err = s.prepareChatRequestBody(body, c.Request.Header)
+	if errors.Is(err, ErrorMessageTooLarge) {
+		s.respondWithError(c, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if errors.Is(err, ErrorLogitBiasTooLarge) {
+		s.respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		s.log.Errorf("Failed to prepare chat request body: %v", err)
-		respondWithError(c, http.StatusInternalServerError, "Failed to prepare chat request body")
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to prepare chat request body")
+		return
+	}
+
+	body, err = s.reconcileAcceptStream(body, c.Request.Header)
+	if err != nil {
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to prepare chat request body")
+		return
+	}
+
+	c.Set(ContextKeyModel, gjson.GetBytes(body, "model").String())
+	c.Set(ContextKeyStream, gjson.GetBytes(body, "stream").Bool())
+
+	body, err = s.applyTransformWebhook(c, body)
+	if err != nil {
+		s.respondWithError(c, http.StatusBadGateway, "Failed to transform request body")
+		return
+	}
+	timingFrom(c).lap("transform")
+
+	release, err := s.acquireStreamSlot(ctx, body)
+	if errors.Is(err, ErrorStreamSlotsBusy) {
+		s.respondWithError(c, http.StatusServiceUnavailable, "Too many concurrent streams")
 		return
 	}
+	if err != nil {
+		// The client went away while queued, there is nobody to respond to
+		c.Abort()
+		return
+	}
+	defer release()
+	timingFrom(c).lap("queue")
+
+	proxyURL, requestType := s.cfg.ChatAPIBaseURL+"/chat/completions", RequestTypeChat
+	if s.cfg.ChatToCompletions {
+		if body, err = s.convertChatToCompletions(body); err != nil {
+			s.respondWithError(c, http.StatusInternalServerError, "Failed to prepare chat request body")
+			return
+		}
+		proxyURL, requestType = s.cfg.ChatAPIBaseURL+"/completions", RequestTypeChatToCompletions
+	}
 
-	proxyURL := s.cfg.ChatAPIBaseURL + "/chat/completions"
-	req, err := createProxyRequest(ctx, http.MethodPost, proxyURL, body, s.cfg.ChatAPIKey, s.cfg.ChatAPIOrganization, s.cfg.ChatAPIProject)
+	req, err := createProxyRequest(ctx, http.MethodPost, proxyURL, body, s.upstreamAPIKey(c, s.cfg.ChatAPIKey), s.cfg.ChatAPIOrganization, s.cfg.ChatAPIProject, s.idempotencyKey(body))
 	if err != nil {
 		s.log.Errorf("Failed to create request: %v", err)
-		respondWithError(c, http.StatusInternalServerError, "Failed to create request")
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to create request")
 		return
 	}
 
-	s.handleProxyRequest(c, req, "chat completions")
+	s.handleProxyRequest(c, req, requestType)
 }
 
-func createProxyRequest(ctx context.Context, method, targetURL string, body []byte, apiKey, organization, project string) (*http.Request, error) {
+// handleModerations forwards a moderations request to ModerationsAPIBase. Only the model is
+// mapped, none of the completion transforms apply.
+func (s *ProxyService) handleModerations(c *gin.Context) {
+	ctx := c.Request.Context()
+	if ctx.Err() != nil {
+		s.respondWithError(c, http.StatusRequestTimeout, "Request timeout")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		s.log.Errorf("Failed to read request body: %v", err)
+		s.respondWithError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	timingFrom(c).lap("read")
+
+	model := gjson.GetBytes(body, "model").String()
+	c.Set(ContextKeyRequestedModel, model)
+	if mapped, ok := s.cfg.ModerationsModelMap[model]; ok {
+		if body, err = s.setJSONField(body, "model", mapped); err != nil {
+			s.respondWithError(c, http.StatusInternalServerError, "Failed to prepare moderations request body")
+			return
+		}
+		model = mapped
+	}
+	c.Set(ContextKeyModel, model)
+	timingFrom(c).lap("transform")
+
+	proxyURL := s.cfg.ModerationsAPIBase + "/moderations"
+	req, err := createProxyRequest(ctx, http.MethodPost, proxyURL, body, s.upstreamAPIKey(c, s.cfg.ChatAPIKey), s.cfg.ChatAPIOrganization, s.cfg.ChatAPIProject, s.idempotencyKey(body))
+	if err != nil {
+		s.log.Errorf("Failed to create request: %v", err)
+		s.respondWithError(c, http.StatusInternalServerError, "Failed to create request")
+		return
+	}
+
+	s.handleProxyRequest(c, req, RequestTypeModerations)
+}
+
+// idempotencyKey derives the Idempotency-Key forwarded upstream from the request body, or
+// returns an empty string when forwarding is disabled.
+func (s *ProxyService) idempotencyKey(body []byte) string {
+	if !s.cfg.ForwardIdempotencyKey {
+		return ""
+	}
+	return s.hashRequestBody(body)
+}
+
+// upstreamAPIKey returns the client's bearer token when PreserveClientAuth is set and the
+// client sent one, otherwise the configured key.
+func (s *ProxyService) upstreamAPIKey(c *gin.Context, configuredKey string) string {
+	if !s.cfg.PreserveClientAuth {
+		return configuredKey
+	}
+
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && strings.TrimSpace(token) != "" {
+		s.log.Debugf("Forwarding client Authorization header upstream")
+		return strings.TrimSpace(token)
+	}
+	s.log.Debugf("No client bearer token, forwarding configured API key upstream")
+	return configuredKey
+}
+
+func createProxyRequest(ctx context.Context, method, targetURL string, body []byte, apiKey, organization, project, idempotencyKey string) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, method, targetURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
@@ -178,77 +569,311 @@ func createProxyRequest(ctx context.Context, method, targetURL string, body []by
 	if project != "" {
 		req.Header.Set("OpenAI-Project", project)
 	}
+	// Retries clone the request, so they all carry the same key
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 
 	return req, nil
 }
 
 func (s *ProxyService) handleProxyRequest(c *gin.Context, req *http.Request, requestType string) {
-	resp, err := s.executeHTTPRequestWithRetry(req)
+	s.setMetadataHeaders(c, req)
+	if s.debugHeaders() {
+		s.log.Debugw("Upstream request headers", "method", req.Method, "url", req.URL.String(), "headers", redactHeaders(req.Header))
+	}
+	c.Set(ContextKeyUpstreamStart, time.Now())
+	var resp *http.Response
+	var err error
+	if s.cfg.ReplayDir != "" {
+		resp, err = s.replayResponse(req)
+		if errors.Is(err, ErrorNoRecordedResponse) {
+			s.respondWithError(c, http.StatusNotFound, "No recorded response for request")
+			return
+		}
+	} else {
+		resp, err = s.executeHTTPRequestWithRetry(req, requestType)
+	}
 	if err != nil {
-		s.handleProxyError(c, err, requestType)
+		s.handleProxyError(c, req, err, requestType)
 		return
 	}
+	if s.cfg.CaptureDir != "" {
+		s.captureResponse(req, requestType, resp)
+	}
+	timingFrom(c).add("ttfb", time.Since(c.GetTime(ContextKeyUpstreamStart)))
 	defer resp.Body.Close()
+	if s.debugHeaders() {
+		s.log.Debugw("Upstream response headers", "status", resp.StatusCode, "headers", redactHeaders(resp.Header))
+	}
 
 	s.handleProxyResponse(c, resp, requestType)
 }
 
-func (s *ProxyService) handleProxyError(c *gin.Context, err error, requestType string) {
-	if errors.Is(err, context.Canceled) {
-		respondWithError(c, http.StatusRequestTimeout, "Request timeout")
-	} else {
-		s.log.Errorf("Request %s failed: %v", requestType, err)
-		respondWithError(c, http.StatusInternalServerError, "Internal server error")
+func (s *ProxyService) handleProxyError(c *gin.Context, req *http.Request, err error, requestType string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrorFirstByteTimeout):
+		s.errLog.Errorf("Request %s got no response bytes within first byte timeout %dms, upstream request aborted", requestType, s.cfg.FirstByteTimeoutMs)
+		s.respondWithError(c, http.StatusGatewayTimeout, "Upstream first byte timeout")
+	case errors.Is(err, context.Canceled):
+		// The client has gone away
+		s.respondWithError(c, http.StatusRequestTimeout, "Request timeout")
+		return
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		s.errLog.Errorf("Request %s timed out waiting for upstream: %v", requestType, err)
+		s.respondWithError(c, http.StatusGatewayTimeout, "Upstream request timeout")
+	default:
+		s.errLog.Errorf("Request %s failed: %v", requestType, err)
+		s.respondWithError(c, http.StatusInternalServerError, "Internal server error")
+	}
+
+	// Retries are exhausted at this point, so the failure is terminal
+	if s.deadLetter != nil {
+		s.deadLetter.record(req, requestType, c.Writer.Status(), err)
 	}
 }
 
 func (s *ProxyService) handleProxyResponse(c *gin.Context, resp *http.Response, requestType string) {
+	if s.cfg.ExposeModelHeader {
+		c.Header(HeaderLdorModel, c.GetString(ContextKeyModel))
+		if requested := c.GetString(ContextKeyRequestedModel); requested != "" {
+			c.Header(HeaderLdorRequestedModel, requested)
+		}
+	}
+
+	if s.cfg.ForwardUpstreamID {
+		if id := resp.Header.Get(s.cfg.UpstreamIDHeader); id != "" {
+			c.Header(HeaderUpstreamRequestID, id)
+		}
+	}
+
+	if s.statusHist != nil {
+		s.statusHist.record(requestType, resp.StatusCode, time.Now())
+	}
+	// Total is taken here, before the body is forwarded, as later headers are not sent
+	if rt := timingFrom(c); rt != nil {
+		c.Header(HeaderLdorTiming, rt.header())
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		s.log.Errorf("Request %s failed with status code %d: %s", requestType, resp.StatusCode, string(body))
-		respondWithError(c, resp.StatusCode, "Proxy request failed")
+		if s.cfg.SoftContentFilter && requestType != RequestTypeModerations && s.isContentFilterError(resp.StatusCode, body) {
+			s.log.Warnf("Request %s was rejected by the upstream content filter, returning an empty completion: %s", requestType, string(body))
+			respondWithEmptyCompletion(c, requestType)
+			return
+		}
+		s.errLog.Errorf("Request %s failed with status code %d: %s", requestType, resp.StatusCode, string(body))
+		s.respondWithError(c, resp.StatusCode, "Proxy request failed")
 		return
 	}
 
+	var reader io.Reader = resp.Body
+	if s.cfg.FirstByteTimeoutMs > 0 {
+		firstChunk, err := readFirstChunk(resp.Body)
+		if err != nil {
+			if errors.Is(err, ErrorFirstByteTimeout) {
+				s.log.Errorf("Request %s got no response bytes within first byte timeout %dms, upstream read aborted", requestType, s.cfg.FirstByteTimeoutMs)
+				s.respondWithError(c, http.StatusGatewayTimeout, "Upstream first byte timeout")
+			} else {
+				s.log.Errorf("Failed to read response body: %v", err)
+				s.respondWithError(c, http.StatusBadGateway, "Failed to read upstream response")
+			}
+			return
+		}
+		reader = io.MultiReader(bytes.NewReader(firstChunk), resp.Body)
+	}
+
+	// Only server-sent events are streamed, a chunked JSON body is a regular response
+	contentType := resp.Header.Get("Content-Type")
+	streaming := isEventStream(contentType)
+	transforms := s.newResponseTransforms(c, requestType)
+	// Buffering a transparently decompressed body surfaces corrupt gzip data before any
+	// byte is forwarded, instead of truncating an already started 200 response. BufferNonSSE
+	// does the same for upstreams that cut chunked responses short.
+	validateGzip := s.cfg.ValidateGzip && resp.Uncompressed
+	if !streaming && (len(transforms.body) > 0 || validateGzip || s.cfg.BufferNonSSE) {
+		body, err := io.ReadAll(reader)
+		if err == nil {
+			body, err = transforms.applyBody(body)
+		}
+		if err != nil {
+			s.log.Errorf("Failed to process %s response body: %v", requestType, err)
+			s.respondWithError(c, http.StatusBadGateway, "Failed to process upstream response")
+			return
+		}
+		reader = bytes.NewReader(body)
+		c.Header("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	switch {
+	case streaming && s.cfg.StreamContentType != "":
+		contentType = s.cfg.StreamContentType
+	case !streaming && s.cfg.ResponseContentType != "":
+		contentType = s.cfg.ResponseContentType
+	}
+
 	c.Status(resp.StatusCode)
-	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+	if contentType != "" {
 		c.Header("Content-Type", contentType)
 	}
 
-	_, err := io.Copy(c.Writer, resp.Body)
+	var err error
+	if streaming {
+		err = s.copyStream(c, reader, c.GetTime(ContextKeyUpstreamStart), transforms)
+	} else {
+		_, err = io.Copy(c.Writer, reader)
+	}
 	if err != nil {
 		s.log.Errorf("Failed to copy response body: %v", err)
 	}
 }
 
+// respondWithError responds with the ErrorMessages entry configured for status, or else
+// with message.
+func (s *ProxyService) respondWithError(c *gin.Context, status int, message string) {
+	respondWithError(c, status, errorMessage(s.cfg.ErrorMessages, status, message))
+}
+
+// errorMessage returns the override configured in messages for status, or message.
+func errorMessage(messages map[int]string, status int, message string) string {
+	if custom, ok := messages[status]; ok {
+		return custom
+	}
+	return message
+}
+
 func respondWithError(c *gin.Context, status int, message string) {
 	c.Header("Content-Type", "application/json")
 	c.AbortWithStatusJSON(status, gin.H{"error": message})
 }
 
-func (s *ProxyService) prepareChatRequestBody(body []byte) ([]byte, error) {
+func (s *ProxyService) respondWithViolations(c *gin.Context, violations []string) {
+	c.Header("Content-Type", "application/json")
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errorMessage(s.cfg.ErrorMessages, http.StatusBadRequest, "Invalid request body"), "violations": violations})
+}
+
+func (s *ProxyService) prepareChatRequestBody(body []byte, header http.Header) ([]byte, error) {
 	var err error
 
+	// Copy mapped request headers into the body
+	body, err = s.applyHeaderToBody(body, header)
+	if err != nil {
+		return nil, err
+	}
+
 	// Set model
-	body, err = s.setModelIfMapped(body, "model", s.cfg.ChatModelMapping, s.cfg.ChatDefaultModel)
+	if !s.cfg.DisableModelMapping {
+		body, err = s.setModelIfMapped(body, "model", s.cfg.ChatModelMapping, s.cfg.ChatDefaultModel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Strip BOMs and CRLFs from the message text
+	body, err = s.normalizePrompt(body)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set locale if necessary
-	body, err = s.setLocaleIfNeeded(body)
+	// Turn off streaming for clients that cannot handle it
+	body, err = s.forceNonStream(body, header)
 	if err != nil {
 		return nil, err
 	}
 
+	// Cut or reject oversized individual messages
+	body, err = s.limitMessageContent(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Truncate prompt if it exceeds the configured length
+	body, err = s.truncateChatMessages(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downgrade system messages for models that reject the role
+	body, err = s.downgradeSystemRole(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge consecutive messages of the same role
+	body, err = s.mergeConsecutiveRoles(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set locale if necessary
+	if !s.cfg.DisableLocale {
+		body, err = s.setLocaleIfNeeded(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Delete unnecessary fields
-	fieldsToDelete := []string{"intent", "intent_threshold", "intent_content"}
-	if body, err = s.deleteFields(body, fieldsToDelete); err != nil {
+	if !s.cfg.DisableFieldDeletion {
+		fieldsToDelete := []string{"intent", "intent_threshold", "intent_content"}
+		if body, err = s.deleteFields(body, fieldsToDelete); err != nil {
+			return nil, err
+		}
+	}
+
+	// Clamp or strip penalties
+	body, err = s.applyPenaltyMode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cap the logit_bias map
+	body, err = s.limitLogitBias(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clamp the number of choices
+	if s.cfg.ChatMaxChoices > 0 && gjson.GetBytes(body, "n").Int() > int64(s.cfg.ChatMaxChoices) {
+		body, err = s.setJSONField(body, "n", s.cfg.ChatMaxChoices)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Set max_tokens if absent, then clamp it
+	body, err = s.setMaxTokensIfAbsent(body, "max_tokens", s.cfg.ChatDefaultMaxTokens)
+	if err != nil {
+		return nil, err
+	}
+	if !s.cfg.DisableTokenClamp {
+		body, err = s.fitMaxTokens(body, s.cfg.ChatMaxTokenCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Merge and clamp stop sequences
+	body, err = s.applyStopSequences(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inject or strip the seed
+	body, err = s.applySeed(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Force a JSON response for capable models
+	body, err = s.forceJSONResponse(body)
+	if err != nil {
 		return nil, err
 	}
 
-	// Set max_tokens if necessary
-	body, err = s.setMaxTokensIfExceeded(body, "max_tokens", s.cfg.ChatMaxTokenCount)
+	// Tell the upstream how long we wait for it
+	body, err = s.injectDeadline(body)
 	if err != nil {
 		return nil, err
 	}
@@ -276,6 +901,11 @@ func (s *ProxyService) setLocaleIfNeeded(body []byte) ([]byte, error) {
 	}
 
 	locale := s.cfg.ChatLocale
+	if s.cfg.AutoLocale {
+		if detected := s.detectLocale(messages); detected != "" {
+			locale = detected
+		}
+	}
 	if locale == "" {
 		locale = DefaultLocale
 	}
@@ -302,6 +932,13 @@ func (s *ProxyService) setMaxTokensIfExceeded(body []byte, key string, maxAllowe
 	return body, nil
 }
 
+func (s *ProxyService) setMaxTokensIfAbsent(body []byte, key string, defaultTokens int) ([]byte, error) {
+	if defaultTokens <= 0 || gjson.GetBytes(body, key).Exists() {
+		return body, nil
+	}
+	return s.setJSONField(body, key, defaultTokens)
+}
+
 func (s *ProxyService) setJSONField(body []byte, key string, value interface{}) ([]byte, error) {
 	newBody, err := sjson.SetBytes(body, key, value)
 	if err != nil {
@@ -315,11 +952,19 @@ func (s *ProxyService) logError(action string, err error) error {
 	return fmt.Errorf("%s: %w", action, err)
 }
 
-func AuthMiddleware(authToken string) gin.HandlerFunc {
+// AuthMiddleware rejects requests whose path token is not authToken. With quietReject the
+// rejection looks like gin's default 404, down to the Content-Type, so probing does not
+// confirm the endpoint exists. Otherwise it answers 401 with the errorMessages override, if
+// one is set.
+func AuthMiddleware(authToken string, quietReject bool, errorMessages map[int]string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Param("token")
 		if token != authToken {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			if quietReject {
+				c.Data(http.StatusNotFound, "text/plain", []byte("404 page not found"))
+			} else {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": errorMessage(errorMessages, http.StatusUnauthorized, "Unauthorized")})
+			}
 			c.Abort()
 			return
 		}
@@ -327,7 +972,39 @@ func AuthMiddleware(authToken string) gin.HandlerFunc {
 	}
 }
 
-func (s *ProxyService) prepareCodeRequestBody(body []byte) []byte {
+// MaxHeaderBytesMiddleware rejects requests whose headers exceed limit bytes with 431. The
+// orbit server does not expose http.Server.MaxHeaderBytes, so the check runs per request once
+// the headers have been read, and the server's own header limit still applies before it.
+func MaxHeaderBytesMiddleware(limit int, errorMessages map[int]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size := len(c.Request.Method) + len(c.Request.RequestURI) + len(c.Request.Proto) + 4
+		for name, values := range c.Request.Header {
+			for _, value := range values {
+				size += len(name) + len(value) + 4
+			}
+		}
+		if size > limit {
+			respondWithError(c, http.StatusRequestHeaderFieldsTooLarge, errorMessage(errorMessages, http.StatusRequestHeaderFieldsTooLarge, "Request header fields too large"))
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *ProxyService) prepareCodeRequestBody(body []byte, header http.Header) []byte {
+	// Copy mapped request headers into the body, the error is already logged
+	if enriched, err := s.applyHeaderToBody(body, header); err == nil {
+		body = enriched
+	}
+
+	if normalized, err := s.normalizePrompt(body); err == nil {
+		body = normalized
+	}
+
+	if buffered, err := s.forceNonStream(body, header); err == nil {
+		body = buffered
+	}
+
 	var err error
 	body, err = sjson.DeleteBytes(body, "extra")
 	if err != nil {
@@ -344,6 +1021,13 @@ func (s *ProxyService) prepareCodeRequestBody(body []byte) []byte {
 		s.log.Errorf("Error setting model: %v", err)
 	}
 
+	if s.cfg.CodexDefaultMaxTokens > 0 && !gjson.GetBytes(body, "max_tokens").Exists() {
+		body, err = sjson.SetBytes(body, "max_tokens", s.cfg.CodexDefaultMaxTokens)
+		if err != nil {
+			s.log.Errorf("Error setting max_tokens: %v", err)
+		}
+	}
+
 	maxTokens := gjson.GetBytes(body, "max_tokens").Int()
 	if int(maxTokens) > s.cfg.CodexMaxTokenCount {
 		body, err = sjson.SetBytes(body, "max_tokens", s.cfg.CodexMaxTokenCount)
@@ -352,6 +1036,36 @@ func (s *ProxyService) prepareCodeRequestBody(body []byte) []byte {
 		}
 	}
 
+	if newBody, err := s.limitLogprobs(body); err == nil {
+		body = newBody
+	}
+
+	if newBody, err := s.applyStopSequences(body); err == nil {
+		body = newBody
+	}
+
+	if newBody, err := s.injectDeadline(body); err == nil {
+		body = newBody
+	}
+
+	// Override the client temperature, this also covers the chat conversions below
+	if s.cfg.CodeTemperature != nil {
+		body, err = sjson.SetBytes(body, "temperature", *s.cfg.CodeTemperature)
+		if err != nil {
+			s.log.Errorf("Error setting temperature: %v", err)
+		}
+	}
+
+	body = s.truncateCodePrompt(body)
+
+	if s.cfg.codexContextPrefix != "" {
+		prompt := gjson.GetBytes(body, "prompt").String()
+		body, err = sjson.SetBytes(body, "prompt", s.cfg.codexContextPrefix+prompt)
+		if err != nil {
+			s.log.Errorf("Error setting prompt: %v", err)
+		}
+	}
+
 	switch {
 	// stable-code model
 	case strings.Contains(s.cfg.CodeInstructionModel, StableCodeModel):
@@ -390,8 +1104,45 @@ func (s *ProxyService) prepareDeepSeekCoderModelRequest(body []byte) []byte {
 	return body
 }
 
-func (s *ProxyService) prepareChatModelRequest(body []byte, messages interface{}) []byte {
+// preserveFIMFields keeps only the fields ldor manages and the FIMPreserveFields of a
+// completion body converted to a chat request, so completion-only fields like prompt and
+// suffix are dropped. The managed fields hold the clamps and overrides applied earlier in
+// prepareCodeRequestBody and are always kept.
+func (s *ProxyService) preserveFIMFields(body []byte) []byte {
+	fields := []string{"model", "stream", "max_tokens", "temperature", "stop"}
+	if s.cfg.DeadlineBodyPath != "" {
+		fields = append(fields, s.cfg.DeadlineBodyPath)
+	}
+	for _, path := range s.cfg.HeaderToBody {
+		fields = append(fields, path)
+	}
+
+	preserved := []byte("{}")
+	for _, field := range append(fields, s.cfg.FIMPreserveFields...) {
+		value := gjson.GetBytes(body, field)
+		if !value.Exists() {
+			continue
+		}
+		newBody, err := sjson.SetRawBytes(preserved, field, []byte(value.Raw))
+		if err != nil {
+			s.log.Errorf("Error preserving %s: %v", field, err)
+			continue
+		}
+		preserved = newBody
+	}
+	return preserved
+}
+
+func (s *ProxyService) prepareChatModelRequest(body []byte, messages []map[string]string) []byte {
 	var err error
+	if len(s.cfg.FIMPreserveFields) > 0 {
+		body = s.preserveFIMFields(body)
+	}
+
+	if s.cfg.CodeSystemPrompt != "" {
+		messages = append([]map[string]string{{"role": "system", "content": s.cfg.CodeSystemPrompt}}, messages...)
+	}
+
 	body, err = sjson.SetBytes(body, "messages", messages)
 	if err != nil {
 		s.log.Errorf("Error setting messages: %v", err)
@@ -405,17 +1156,54 @@ func (s *ProxyService) prepareChatModelRequest(body []byte, messages interface{}
 	return []byte(jsonStr)
 }
 
+// tlsVersions maps the accepted upstream_min_tls_version values to their crypto/tls ids.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 func createHTTPClient(cfg *ServiceConfig) (*http.Client, error) {
 	transport := &http.Transport{
-		ForceAttemptHTTP2:   true,
+		ForceAttemptHTTP2:   !cfg.DisableHTTP2,
 		DisableKeepAlives:   false,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 		IdleConnTimeout:     90 * time.Second,
 	}
 
-	if err := http2.ConfigureTransport(transport); err != nil {
-		return nil, fmt.Errorf("failed to configure HTTP/2 transport: %w", err)
+	// Fail fast on unreachable upstreams instead of waiting for the whole request timeout
+	if cfg.DialTimeoutMs > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(cfg.DialTimeoutMs) * time.Millisecond, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+
+	minVersion, ok := tlsVersions[cfg.MinTLSVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported upstream minimum TLS version: %q", cfg.MinTLSVersion)
+	}
+	transport.TLSClientConfig = &tls.Config{MinVersion: minVersion}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map stops net/http from enabling HTTP/2 on its own
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else {
+		h2Transport, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure HTTP/2 transport: %w", err)
+		}
+		h2Transport.StrictMaxConcurrentStreams = cfg.HTTP2StrictMaxStreams
+		h2Transport.ReadIdleTimeout = time.Duration(cfg.HTTP2ReadIdleTimeoutMs) * time.Millisecond
+		h2Transport.PingTimeout = time.Duration(cfg.HTTP2PingTimeoutMs) * time.Millisecond
 	}
 
 	if cfg.ProxyURL != "" {
@@ -434,12 +1222,80 @@ func createHTTPClient(cfg *ServiceConfig) (*http.Client, error) {
 	return client, nil
 }
 
-func (s *ProxyService) executeHTTPRequestWithRetry(req *http.Request) (*http.Response, error) {
-	result := s.retrier.TryOnConflict(func() (interface{}, error) {
-		return s.client.Do(req)
+func (s *ProxyService) executeHTTPRequestWithRetry(req *http.Request, requestType string) (*http.Response, error) {
+	// lastResp keeps the last response that caused a retry, it is forwarded once retries are used up
+	var lastResp *http.Response
+	emptyRetries := 0
+	state := &retryState{deadline: time.Now().Add(time.Duration(s.cfg.TimeoutSeconds) * time.Second)}
+
+	result := s.newRetrier(req.Context(), state).TryOnConflict(func() (interface{}, error) {
+		attemptReq, err := cloneRequestWithBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var fbt *firstByteTimer
+		if s.cfg.FirstByteTimeoutMs > 0 {
+			attemptReq, fbt = withFirstByteTimeout(attemptReq, time.Duration(s.cfg.FirstByteTimeoutMs)*time.Millisecond)
+		}
+		resp, err := s.client.Do(attemptReq)
+		if fbt != nil {
+			if err != nil {
+				fbt.cancel()
+				return nil, fbt.err(err)
+			}
+			resp.Body = fbt.wrap(resp.Body)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if lastResp != nil {
+			lastResp.Body.Close()
+			lastResp = nil
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			state.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			fbt.stop()
+			lastResp = resp
+			return nil, ErrorUpstreamRateLimited
+		}
+		state.retryAfter = 0
+
+		// 5xx responses are only retried when their category has a retry limit
+		if _, ok := s.cfg.RetryCategoryLimits[RetryCategory5xx]; ok && resp.StatusCode >= http.StatusInternalServerError {
+			fbt.stop()
+			lastResp = resp
+			return nil, ErrorUpstreamServerError
+		}
+
+		if s.cfg.RetryOnEmptyCompletion && requestType != RequestTypeModerations && emptyRetries < s.cfg.EmptyCompletionRetries && resp.StatusCode == http.StatusOK && !isEventStream(resp.Header.Get("Content-Type")) {
+			empty, err := s.isEmptyCompletion(resp, requestType)
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			if empty {
+				emptyRetries++
+				lastResp = resp
+				return nil, ErrorEmptyCompletion
+			}
+		}
+
+		return resp, nil
 	})
 
 	if !result.IsSuccess() {
+		if lastResp != nil {
+			if errors.Is(result.TryError(), retry.ErrorRetryAttemptsExceeded) || errors.Is(result.TryError(), retry.ErrorRetryIf) {
+				return lastResp, nil
+			}
+			lastResp.Body.Close()
+		}
+		if lastErr := result.LastExecError(); !errors.Is(lastErr, retry.ErrorExecErrNotFound) {
+			return nil, fmt.Errorf("%w: %w", result.TryError(), lastErr)
+		}
 		return nil, result.TryError()
 	}
 
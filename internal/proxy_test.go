@@ -0,0 +1,903 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func TestPrepareChatModelRequestPreservesFields(t *testing.T) {
+	body := []byte(`{"model":"stable-code","prompt":"p","suffix":"s","max_tokens":64,"temperature":0.1,"stop":["\n"],"top_p":0.9,"echo":true,"deadline":5}`)
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "without preserve list the body is kept",
+			cfg:     &ServiceConfig{},
+			present: []string{"prompt", "suffix", "top_p", "max_tokens"},
+		},
+		{
+			name:    "managed fields survive the preserve list",
+			cfg:     &ServiceConfig{FIMPreserveFields: []string{"top_p"}, DeadlineBodyPath: "deadline"},
+			present: []string{"model", "max_tokens", "temperature", "stop", "top_p", "deadline"},
+			absent:  []string{"prompt", "suffix", "echo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := newTestService(t, tt.cfg).prepareStableCodeModelRequest(body)
+			if !gjson.GetBytes(out, "messages.0.content").Exists() {
+				t.Fatalf("messages missing: %s", out)
+			}
+			for _, field := range tt.present {
+				if !gjson.GetBytes(out, field).Exists() {
+					t.Errorf("field %s missing: %s", field, out)
+				}
+			}
+			for _, field := range tt.absent {
+				if gjson.GetBytes(out, field).Exists() {
+					t.Errorf("field %s kept: %s", field, out)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorMessageOverrides(t *testing.T) {
+	overrides := map[int]string{
+		http.StatusUnauthorized:                "Bad token",
+		http.StatusRequestHeaderFieldsTooLarge: "Headers too big",
+		http.StatusBadRequest:                  "Malformed",
+	}
+
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "auth default",
+			handler:    AuthMiddleware("secret", false, nil),
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "Unauthorized",
+		},
+		{
+			name:       "auth override",
+			handler:    AuthMiddleware("secret", false, overrides),
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "Bad token",
+		},
+		{
+			name:       "header size override",
+			handler:    MaxHeaderBytesMiddleware(16, overrides),
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+			wantError:  "Headers too big",
+		},
+		{
+			name: "violations override",
+			handler: func(c *gin.Context) {
+				newTestService(t, &ServiceConfig{ErrorMessages: overrides}).respondWithViolations(c, []string{"model is required"})
+			},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "Malformed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.POST("/:token/v1/chat/completions", tt.handler, func(c *gin.Context) { c.Status(http.StatusOK) })
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/wrong/v1/chat/completions", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := gjson.Get(w.Body.String(), "error").String(); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestAuthQuietReject(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		quiet      bool
+		path       string
+		wantStatus int
+	}{
+		{name: "valid token", quiet: true, path: "/secret/v1/engines/copilot-codex/completions", wantStatus: http.StatusOK},
+		{name: "invalid token", path: "/wrong/v1/engines/copilot-codex/completions", wantStatus: http.StatusUnauthorized},
+		{name: "invalid token quietly", quiet: true, path: "/wrong/v1/engines/copilot-codex/completions", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{AuthToken: "secret", AuthQuietReject: tt.quiet}, respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`))
+
+			w := tp.do(http.MethodPost, tt.path, `{"prompt":"p"}`, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusNotFound {
+				return
+			}
+			// The rejection is indistinguishable from an unknown route
+			unknown := tp.do(http.MethodPost, "/unknown", `{}`, nil)
+			if w.Body.String() != unknown.Body.String() || w.Header().Get("Content-Type") != unknown.Header().Get("Content-Type") {
+				t.Errorf("rejection = %q (%s), want %q (%s)", w.Body.String(), w.Header().Get("Content-Type"), unknown.Body.String(), unknown.Header().Get("Content-Type"))
+			}
+			if calls := tp.upstreamCalls(); calls != 0 {
+				t.Errorf("upstream calls = %d, want 0", calls)
+			}
+		})
+	}
+}
+
+func TestRouteRateLimits(t *testing.T) {
+	t.Parallel()
+	tp := newTestProxy(t, &ServiceConfig{ChatRequestsPerSec: 1}, respondJSON(http.StatusOK, `{"choices":[]}`))
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "first chat request", path: "/v1/chat/completions", body: `{"messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusOK},
+		{name: "second chat request is limited", path: "/v1/chat/completions", body: `{"messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusTooManyRequests},
+		{name: "code route keeps the global limit", path: "/v1/engines/copilot-codex/completions", body: `{"prompt":"x"}`, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := tp.do(http.MethodPost, tt.path, tt.body, nil); w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCodeSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		wantRoles []string
+	}{
+		{name: "without system prompt", wantRoles: []string{"user"}},
+		{name: "with system prompt", prompt: "Complete the code.", wantRoles: []string{"system", "user"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, &ServiceConfig{CodeInstructionModel: StableCodeModel, CodeSystemPrompt: tt.prompt})
+			out := s.prepareCodeRequestBody([]byte(`{"prompt":"a<b","suffix":"c"}`), http.Header{})
+
+			messages := gjson.GetBytes(out, "messages").Array()
+			if len(messages) != len(tt.wantRoles) {
+				t.Fatalf("messages = %s, want roles %v", gjson.GetBytes(out, "messages").Raw, tt.wantRoles)
+			}
+			for i, role := range tt.wantRoles {
+				if got := messages[i].Get("role").String(); got != role {
+					t.Errorf("role %d = %s, want %s", i, got, role)
+				}
+			}
+			if tt.prompt != "" && messages[0].Get("content").String() != tt.prompt {
+				t.Errorf("system content = %s, want %s", messages[0].Get("content"), tt.prompt)
+			}
+			if got := messages[len(messages)-1].Get("content").String(); got != "<fim_prefix>a<b<fim_suffix>c<fim_middle>" {
+				t.Errorf("user content = %s", got)
+			}
+		})
+	}
+}
+
+func TestCodexContextPrefix(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "context.txt")
+	if err := os.WriteFile(file, []byte("# repo: ldor\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		model  string
+		want   string
+		path   string
+	}{
+		{name: "no prefix", want: "def f():", path: "prompt"},
+		{name: "inline prefix", prefix: "# repo: ldor\n", want: "# repo: ldor\ndef f():", path: "prompt"},
+		{name: "file prefix", prefix: "file:" + file, want: "# repo: ldor\ndef f():", path: "prompt"},
+		{
+			name:   "prefix before FIM wrapping",
+			prefix: "# repo: ldor\n",
+			model:  StableCodeModel,
+			want:   "<fim_prefix># repo: ldor\ndef f():<fim_suffix>pass<fim_middle>",
+			path:   "messages.0.content",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, &ServiceConfig{CodeInstructionModel: tt.model, CodexContextPrefix: tt.prefix})
+			out := s.prepareCodeRequestBody([]byte(`{"prompt":"def f():","suffix":"pass"}`), http.Header{})
+			if got := gjson.GetBytes(out, tt.path).String(); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodexContextPrefixFileReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "context.txt")
+	cfg := &ServiceConfig{CodexContextPrefix: "file:" + file}
+
+	for _, content := range []string{"first\n", "second\n"} {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.LoadDefaults(); err != nil {
+			t.Fatalf("LoadDefaults() error = %v", err)
+		}
+		if cfg.codexContextPrefix != content {
+			t.Errorf("context prefix = %q, want %q", cfg.codexContextPrefix, content)
+		}
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.LoadDefaults(); err == nil {
+		t.Error("LoadDefaults() with a missing context file succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay int
+	}{
+		{name: "without delay"},
+		{name: "with delay", delay: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, &ServiceConfig{PreShutdownDelayMs: tt.delay}, respondJSON(http.StatusOK, `{}`))
+			if w := tp.do(http.MethodGet, "/readyz", "", nil); w.Code != http.StatusOK {
+				t.Fatalf("readyz before drain = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			start := time.Now()
+			done := make(chan struct{})
+			go func() {
+				tp.Drain()
+				close(done)
+			}()
+
+			// The service reports not ready but keeps serving during the delay
+			time.Sleep(20 * time.Millisecond)
+			if w := tp.do(http.MethodGet, "/readyz", "", nil); w.Code != http.StatusServiceUnavailable {
+				t.Errorf("readyz while draining = %d, want %d", w.Code, http.StatusServiceUnavailable)
+			}
+			if w := tp.do(http.MethodGet, "/_ping", "", nil); w.Code != http.StatusOK {
+				t.Errorf("ping while draining = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			<-done
+			if elapsed := time.Since(start); elapsed < time.Duration(tt.delay)*time.Millisecond {
+				t.Errorf("drain returned after %v, want at least %dms", elapsed, tt.delay)
+			}
+		})
+	}
+}
+
+func TestDefaultMaxTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTokens string
+		want      int64
+	}{
+		{name: "absent", want: 256},
+		{name: "within limit", maxTokens: `,"max_tokens":100`, want: 100},
+		{name: "over limit", maxTokens: `,"max_tokens":5000`, want: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, &ServiceConfig{
+				ChatDefaultMaxTokens:  256,
+				ChatMaxTokenCount:     1024,
+				CodexDefaultMaxTokens: 256,
+				CodexMaxTokenCount:    1024,
+			})
+
+			chat, err := s.prepareChatRequestBody([]byte(`{"messages":[{"role":"user","content":"hi"}]`+tt.maxTokens+`}`), http.Header{})
+			if err != nil {
+				t.Fatalf("prepareChatRequestBody() error = %v", err)
+			}
+			if got := gjson.GetBytes(chat, "max_tokens").Int(); got != tt.want {
+				t.Errorf("chat max_tokens = %d, want %d", got, tt.want)
+			}
+
+			code := s.prepareCodeRequestBody([]byte(`{"prompt":"p"`+tt.maxTokens+`}`), http.Header{})
+			if got := gjson.GetBytes(code, "max_tokens").Int(); got != tt.want {
+				t.Errorf("codex max_tokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeTemperature(t *testing.T) {
+	forced := 0.2
+	tests := []struct {
+		name        string
+		temperature *float64
+		body        string
+		want        string
+	}{
+		{name: "not forced", body: `{"prompt":"p","temperature":0.8}`, want: "0.8"},
+		{name: "client value overridden", temperature: &forced, body: `{"prompt":"p","temperature":0.8}`, want: "0.2"},
+		{name: "absent value set", temperature: &forced, body: `{"prompt":"p"}`, want: "0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, &ServiceConfig{CodeTemperature: tt.temperature})
+
+			code := s.prepareCodeRequestBody([]byte(tt.body), http.Header{})
+			if got := gjson.GetBytes(code, "temperature").Raw; got != tt.want {
+				t.Errorf("codex temperature = %s, want %s", got, tt.want)
+			}
+
+			chat, err := s.prepareChatRequestBody([]byte(`{"messages":[{"role":"user","content":"hi"}],"temperature":0.8}`), http.Header{})
+			if err != nil {
+				t.Fatalf("prepareChatRequestBody() error = %v", err)
+			}
+			if got := gjson.GetBytes(chat, "temperature").Raw; got != "0.8" {
+				t.Errorf("chat temperature = %s, want 0.8", got)
+			}
+		})
+	}
+}
+
+func TestRegisteredRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "without auth",
+			cfg:     &ServiceConfig{},
+			present: []string{"GET /_ping", "GET /readyz", "GET /v1/models", "POST /v1/chat/completions", "POST /v1/engines/copilot-codex/completions"},
+			absent:  []string{"POST /:token/v1/chat/completions"},
+		},
+		{
+			name:    "with auth",
+			cfg:     &ServiceConfig{AuthToken: "secret"},
+			present: []string{"GET /_ping", "POST /:token/v1/chat/completions", "POST /:token/v1/engines/copilot-codex/completions"},
+			absent:  []string{"POST /v1/chat/completions"},
+		},
+		{
+			name:    "optional routes",
+			cfg:     &ServiceConfig{EnableModerations: true, EnableWebSocket: true},
+			present: []string{"POST /v1/moderations", "GET /v1/chat/completions", "GET /v1/engines/copilot-codex/completions"},
+		},
+		{
+			name:    "default path variants",
+			cfg:     &ServiceConfig{},
+			present: []string{"POST /v1/v1/chat/completions", "POST /v1/v1/engines/copilot-codex/completions"},
+		},
+		{
+			name:    "custom path variants",
+			cfg:     &ServiceConfig{PathVariants: []string{"", "/openai/", "/openai"}},
+			present: []string{"POST /v1/chat/completions", "POST /v1/openai/chat/completions", "POST /v1/openai/engines/copilot-codex/completions"},
+			absent:  []string{"POST /v1/v1/chat/completions"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, tt.cfg, respondJSON(http.StatusOK, `{}`))
+			routes := tp.Routes()
+
+			// Every recorded route is served by the router
+			served := make(map[string]bool)
+			for _, route := range tp.router.Routes() {
+				served[route.Method+" "+route.Path] = true
+			}
+			for _, route := range routes {
+				if !served[route] {
+					t.Errorf("route %s recorded but not served", route)
+				}
+			}
+
+			for _, route := range tt.present {
+				if !slices.Contains(routes, route) {
+					t.Errorf("route %s missing from %q", route, routes)
+				}
+			}
+			for _, route := range tt.absent {
+				if slices.Contains(routes, route) {
+					t.Errorf("route %s unexpectedly registered", route)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleProxyErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "client canceled", err: &url.Error{Op: "Post", URL: "http://upstream", Err: context.Canceled}, want: http.StatusRequestTimeout},
+		{name: "deadline exceeded", err: &url.Error{Op: "Post", URL: "http://upstream", Err: context.DeadlineExceeded}, want: http.StatusGatewayTimeout},
+		{name: "network timeout", err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}, want: http.StatusGatewayTimeout},
+		{name: "first byte timeout", err: ErrorFirstByteTimeout, want: http.StatusGatewayTimeout},
+		{name: "other error", err: errors.New("connection refused"), want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+			newDefaultTestService(t, &ServiceConfig{}).handleProxyError(c, c.Request, tt.err, RequestTypeChat)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	const limit = 1024
+	router := gin.New()
+	router.Use(MaxHeaderBytesMiddleware(limit, nil))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name   string
+		header int
+		want   int
+	}{
+		{name: "small headers", header: 100, want: http.StatusOK},
+		{name: "just over the limit", header: limit, want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "far over the limit", header: 16 * limit, want: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Editor-Context", strings.Repeat("a", tt.header))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseContentTypeOverride(t *testing.T) {
+	t.Parallel()
+	overrides := &ServiceConfig{
+		ResponseContentType: "application/json; charset=utf-8",
+		StreamContentType:   "text/event-stream; charset=utf-8",
+	}
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		body    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name:    "response forwarded verbatim",
+			cfg:     &ServiceConfig{},
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`),
+			want:    "application/json",
+		},
+		{
+			name:    "response override",
+			cfg:     overrides,
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`),
+			want:    "application/json; charset=utf-8",
+		},
+		{
+			name:    "stream override",
+			cfg:     overrides,
+			body:    `{"prompt":"p","stream":true}`,
+			handler: respondEvents([]string{`{"choices":[{"text":"a"}]}`}, false),
+			want:    "text/event-stream; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := *tt.cfg
+			tp := newTestProxy(t, &cfg, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", tt.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreserveClientAuth(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		preserve bool
+		auth     string
+		want     string
+	}{
+		{name: "configured key", auth: "Bearer client-token", want: "Bearer configured-key"},
+		{name: "client token preserved", preserve: true, auth: "Bearer client-token", want: "Bearer client-token"},
+		{name: "no client token", preserve: true, want: "Bearer configured-key"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{CodexAPIKey: "configured-key", PreserveClientAuth: tt.preserve}
+			tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`))
+
+			header := http.Header{}
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+			if w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, header); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			req, _ := tp.lastUpstream(t)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("upstream Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitEnabled(t *testing.T) {
+	t.Parallel()
+	disabled, enabled := false, true
+	tests := []struct {
+		name         string
+		enabled      *bool
+		wantHandlers int
+		wantStatus   int
+	}{
+		{name: "enabled by default", wantHandlers: 3, wantStatus: http.StatusTooManyRequests},
+		{name: "explicitly enabled", enabled: &enabled, wantHandlers: 3, wantStatus: http.StatusTooManyRequests},
+		{name: "disabled", enabled: &disabled, wantHandlers: 1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{RateLimitEnabled: tt.enabled, ChatRequestsPerSec: 1}, respondJSON(http.StatusOK, `{"choices":[]}`))
+
+			handlers := tp.withLimiter(tp.chatLimiter, tp.handleChatCompletions)
+			if len(handlers) != tt.wantHandlers {
+				t.Errorf("handlers = %d, want %d", len(handlers), tt.wantHandlers)
+			}
+
+			// The second request within a second is only limited when the limiter is attached
+			var w *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				w = tp.do(http.MethodPost, "/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}]}`, nil)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("second request status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRateLimitFailMode(t *testing.T) {
+	failing := func(c *gin.Context) { panic("limiter store unavailable") }
+	tests := []struct {
+		name       string
+		mode       string
+		limiter    gin.HandlerFunc
+		wantStatus int
+	}{
+		{name: "fail open", mode: FailModeOpen, limiter: failing, wantStatus: http.StatusOK},
+		{name: "fail closed", mode: FailModeClosed, limiter: failing, wantStatus: http.StatusServiceUnavailable},
+		{name: "healthy limiter", mode: FailModeClosed, limiter: func(c *gin.Context) { c.Next() }, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{RateLimitFailMode: tt.mode})
+			router := gin.New()
+			router.GET("/", s.guardLimiter(tt.limiter), markLimiterPassed, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	// A panic raised by a handler after the limiter passed is not swallowed
+	s := newTestService(t, &ServiceConfig{RateLimitFailMode: FailModeOpen})
+	router := gin.New()
+	router.GET("/", s.guardLimiter(func(c *gin.Context) { c.Next() }), markLimiterPassed, func(c *gin.Context) { panic("handler bug") })
+	defer func() {
+		if recover() == nil {
+			t.Error("handler panic swallowed by the limiter guard")
+		}
+	}()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestValidateGzip(t *testing.T) {
+	t.Parallel()
+	const completion = `{"choices":[{"text":"a"}]}`
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(completion))
+	zw.Close()
+	corrupt := append([]byte(nil), compressed.Bytes()[:compressed.Len()/2]...)
+
+	respondGzip := func(body []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(body)
+		}
+	}
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "valid gzip", handler: respondGzip(compressed.Bytes()), wantStatus: http.StatusOK, wantBody: completion},
+		{name: "corrupt gzip", handler: respondGzip(corrupt), wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ValidateGzip: true}, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBufferNonSSE(t *testing.T) {
+	t.Parallel()
+	const completion = `{"choices":[{"text":"a"}]}`
+	respondChunked := func(truncated bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n")
+			buf.WriteString(fmt.Sprintf("%x\r\n%s\r\n", len(completion), completion))
+			if !truncated {
+				buf.WriteString("0\r\n\r\n")
+			}
+			buf.Flush()
+		}
+	}
+	tests := []struct {
+		name       string
+		buffer     bool
+		truncated  bool
+		wantStatus int
+		wantLength string
+	}{
+		{name: "complete body buffered", buffer: true, wantStatus: http.StatusOK, wantLength: strconv.Itoa(len(completion))},
+		{name: "truncated body forwarded", truncated: true, wantStatus: http.StatusOK},
+		{name: "truncated body rejected", buffer: true, truncated: true, wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{BufferNonSSE: tt.buffer}, respondChunked(tt.truncated))
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestDisableChatTransforms(t *testing.T) {
+	const body = `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"intent":true,"max_tokens":9000}`
+	tests := []struct {
+		name          string
+		cfg           *ServiceConfig
+		wantModel     string
+		wantLocale    bool
+		wantIntent    bool
+		wantMaxTokens int64
+	}{
+		{
+			name:          "all steps",
+			cfg:           &ServiceConfig{},
+			wantModel:     "mapped-model",
+			wantLocale:    true,
+			wantMaxTokens: 1024,
+		},
+		{
+			name:          "model mapping disabled",
+			cfg:           &ServiceConfig{DisableModelMapping: true},
+			wantModel:     "gpt-4",
+			wantLocale:    true,
+			wantMaxTokens: 1024,
+		},
+		{
+			name:          "locale injection disabled",
+			cfg:           &ServiceConfig{DisableLocale: true},
+			wantModel:     "mapped-model",
+			wantMaxTokens: 1024,
+		},
+		{
+			name:          "field deletion disabled",
+			cfg:           &ServiceConfig{DisableFieldDeletion: true},
+			wantModel:     "mapped-model",
+			wantLocale:    true,
+			wantIntent:    true,
+			wantMaxTokens: 1024,
+		},
+		{
+			name:          "max tokens clamp disabled",
+			cfg:           &ServiceConfig{DisableTokenClamp: true},
+			wantModel:     "mapped-model",
+			wantLocale:    true,
+			wantMaxTokens: 9000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.ChatModelMapping = map[string]string{"gpt-4": "mapped-model"}
+			tt.cfg.ChatMaxTokenCount = 1024
+			out, err := newDefaultTestService(t, tt.cfg).prepareChatRequestBody([]byte(body), http.Header{})
+			if err != nil {
+				t.Fatalf("prepareChatRequestBody() error = %v", err)
+			}
+
+			if got := gjson.GetBytes(out, "model").String(); got != tt.wantModel {
+				t.Errorf("model = %s, want %s", got, tt.wantModel)
+			}
+			if got := strings.Contains(gjson.GetBytes(out, "messages.0.content").String(), "Respond in the following locale"); got != tt.wantLocale {
+				t.Errorf("locale injected = %v, want %v", got, tt.wantLocale)
+			}
+			if got := gjson.GetBytes(out, "intent").Exists(); got != tt.wantIntent {
+				t.Errorf("intent kept = %v, want %v", got, tt.wantIntent)
+			}
+			if got := gjson.GetBytes(out, "max_tokens").Int(); got != tt.wantMaxTokens {
+				t.Errorf("max_tokens = %d, want %d", got, tt.wantMaxTokens)
+			}
+		})
+	}
+}
+
+func TestModerations(t *testing.T) {
+	t.Parallel()
+	const result = `{"results":[{"flagged":false}]}`
+	tests := []struct {
+		name       string
+		enabled    bool
+		model      string
+		wantStatus int
+		wantModel  string
+	}{
+		{name: "disabled", model: "text-moderation-latest", wantStatus: http.StatusNotFound},
+		{name: "mapped model", enabled: true, model: "text-moderation-latest", wantStatus: http.StatusOK, wantModel: "omni-moderation-latest"},
+		{name: "unmapped model", enabled: true, model: "custom", wantStatus: http.StatusOK, wantModel: "custom"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{
+				EnableModerations:   tt.enabled,
+				ModerationsModelMap: map[string]string{"text-moderation-latest": "omni-moderation-latest"},
+				ChatAPIKey:          "sk-chat",
+				EnsureResponseID:    true,
+			}
+			tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, result))
+
+			w := tp.do(http.MethodPost, "/v1/moderations", `{"model":"`+tt.model+`","input":"hi"}`, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			// The result is forwarded untouched, without completion post-processing
+			if w.Body.String() != result {
+				t.Errorf("body = %s, want %s", w.Body.String(), result)
+			}
+
+			req, body := tp.lastUpstream(t)
+			if req.URL.Path != "/moderations" {
+				t.Errorf("upstream path = %s, want /moderations", req.URL.Path)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer sk-chat" {
+				t.Errorf("Authorization = %q, want the chat key", got)
+			}
+			if got := gjson.GetBytes(body, "model").String(); got != tt.wantModel {
+				t.Errorf("upstream model = %s, want %s", got, tt.wantModel)
+			}
+			if got := gjson.GetBytes(body, "input").String(); got != "hi" {
+				t.Errorf("upstream input = %q, want hi", got)
+			}
+		})
+	}
+}
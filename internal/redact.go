@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// RedactedValue replaces secret values in logs.
+const RedactedValue = "***"
+
+// secretHeaders lists the headers whose values must never be logged.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"Api-Key":             true,
+}
+
+// secretBodyFields lists the top-level request body fields whose values must never be logged.
+var secretBodyFields = []string{"api_key", "apiKey", "token", "access_token", "authorization"}
+
+// redactSecret masks a secret value, keeping an auth scheme such as "Bearer" visible.
+func redactSecret(value string) string {
+	if scheme, _, ok := strings.Cut(value, " "); ok {
+		return scheme + " " + RedactedValue
+	}
+	return RedactedValue
+}
+
+// redactHeaders returns a copy of header with the values of secret headers masked.
+func redactHeaders(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if !secretHeaders[http.CanonicalHeaderKey(name)] {
+			redacted[name] = values
+			continue
+		}
+		masked := make([]string, len(values))
+		for i, value := range values {
+			masked[i] = redactSecret(value)
+		}
+		redacted[name] = masked
+	}
+	return redacted
+}
+
+// redactBody returns a copy of a JSON request body with the secret fields masked.
+func redactBody(body []byte) []byte {
+	redacted := body
+	for _, field := range secretBodyFields {
+		if !gjson.GetBytes(redacted, field).Exists() {
+			continue
+		}
+		if masked, err := sjson.SetBytes(redacted, field, RedactedValue); err == nil {
+			redacted = masked
+		}
+	}
+	return redacted
+}
+
+// ElideMessages returns a copy of a chat request body for logging whose messages array keeps
+// only its first and last entries, maxMessages in total, around an elision marker.
+func ElideMessages(body []byte, maxMessages int) []byte {
+	messages := gjson.GetBytes(body, "messages")
+	if maxMessages <= 0 || !messages.IsArray() {
+		return body
+	}
+	items := messages.Array()
+	if len(items) <= maxMessages {
+		return body
+	}
+
+	head, tail := (maxMessages+1)/2, maxMessages/2
+	raws := make([]string, 0, maxMessages+1)
+	for _, item := range items[:head] {
+		raws = append(raws, item.Raw)
+	}
+	raws = append(raws, strconv.Quote(fmt.Sprintf("... %d messages elided ...", len(items)-maxMessages)))
+	for _, item := range items[len(items)-tail:] {
+		raws = append(raws, item.Raw)
+	}
+
+	elided, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(raws, ",")+"]"))
+	if err != nil {
+		return body
+	}
+	return elided
+}
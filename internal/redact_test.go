@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   string
+	}{
+		{name: "bearer token", header: "Authorization", value: "Bearer sk-secret", want: "Bearer ***"},
+		{name: "api key", header: "x-api-key", value: "sk-secret", want: "***"},
+		{name: "cookie", header: "Cookie", value: "session=secret", want: "***"},
+		{name: "plain header", header: "Content-Type", value: "application/json", want: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(tt.header, tt.value)
+
+			if got := redactHeaders(header).Get(tt.header); got != tt.want {
+				t.Errorf("redacted %s = %q, want %q", tt.header, got, tt.want)
+			}
+			if got := header.Get(tt.header); got != tt.value {
+				t.Errorf("original %s = %q, want it untouched", tt.header, got)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	body := []byte(`{"api_key":"sk-secret","token":"t","prompt":"p"}`)
+	redacted := redactBody(body)
+
+	for field, want := range map[string]string{"api_key": RedactedValue, "token": RedactedValue, "prompt": "p"} {
+		if got := gjson.GetBytes(redacted, field).String(); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+	if gjson.GetBytes(body, "api_key").String() != "sk-secret" {
+		t.Errorf("original body modified: %s", body)
+	}
+}
+
+func TestDebugHeadersLogged(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		debug        bool
+		debugHeaders bool
+		wantLogs     int
+	}{
+		{name: "toggle off", debug: true},
+		{name: "debug mode off", debugHeaders: true},
+		{name: "logged", debug: true, debugHeaders: true, wantLogs: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{CodexAPIKey: "sk-secret", DebugHeaders: tt.debugHeaders}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Set-Cookie", "session=secret")
+				respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`)(w, r)
+			})
+			core, logs := observer.New(zapcore.DebugLevel)
+			tp.log = zap.New(core).Sugar()
+			tp.SetDebugMode(tt.debug)
+
+			if w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			entries := logs.FilterMessageSnippet("headers").All()
+			if len(entries) != tt.wantLogs {
+				t.Fatalf("header log entries = %d, want %d", len(entries), tt.wantLogs)
+			}
+			for _, entry := range entries {
+				logged := fmt.Sprint(entry.ContextMap()["headers"])
+				if strings.Contains(logged, "secret") || !strings.Contains(logged, RedactedValue) {
+					t.Errorf("%s = %s, want masked secrets", entry.Message, logged)
+				}
+			}
+		})
+	}
+}
+
+func TestElideMessages(t *testing.T) {
+	body := `{"model":"m","messages":[{"content":"1"},{"content":"2"},{"content":"3"},{"content":"4"},{"content":"5"}]}`
+	tests := []struct {
+		name        string
+		body        string
+		maxMessages int
+		want        string
+	}{
+		{name: "disabled", body: body, want: body},
+		{name: "within limit", body: body, maxMessages: 5, want: body},
+		{name: "no messages", body: `{"prompt":"p"}`, maxMessages: 1, want: `{"prompt":"p"}`},
+		{
+			name:        "odd limit keeps more head",
+			body:        body,
+			maxMessages: 3,
+			want:        `{"model":"m","messages":[{"content":"1"},{"content":"2"},"... 2 messages elided ...",{"content":"5"}]}`,
+		},
+		{
+			name:        "even limit",
+			body:        body,
+			maxMessages: 2,
+			want:        `{"model":"m","messages":[{"content":"1"},"... 3 messages elided ...",{"content":"5"}]}`,
+		},
+		{
+			name:        "single message kept",
+			body:        body,
+			maxMessages: 1,
+			want:        `{"model":"m","messages":[{"content":"1"},"... 4 messages elided ..."]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ElideMessages([]byte(tt.body), tt.maxMessages); string(got) != tt.want {
+				t.Errorf("ElideMessages() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// defaultFinishReasonMap maps finish reasons used by non-OpenAI upstreams to OpenAI values.
+var defaultFinishReasonMap = map[string]string{
+	"eos":           "stop",
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"max_length":    "length",
+}
+
+// bodyTransform rewrites a buffered response body.
+type bodyTransform func(body []byte) ([]byte, error)
+
+// frameTransform rewrites the JSON payload of a streamed `data:` frame. Returning a nil
+// payload drops the frame.
+type frameTransform func(payload []byte) ([]byte, error)
+
+// streamTail produces an extra `data:` payload emitted right before the terminal [DONE]
+// frame. Returning a nil payload emits nothing.
+type streamTail func() ([]byte, error)
+
+// responseTransforms holds the post-processing steps applied to a single response.
+// A frame transform sets stopped to end the stream after the current frame, sawDone
+// records whether the upstream sent the terminal [DONE] frame.
+type responseTransforms struct {
+	body    []bodyTransform
+	frames  []frameTransform
+	tails   []streamTail
+	stopped bool
+	sawDone bool
+}
+
+// newResponseTransforms collects the response post-processing steps for a request.
+func (s *ProxyService) newResponseTransforms(c *gin.Context, requestType string) *responseTransforms {
+	rt := &responseTransforms{}
+	// Moderation results are not completions, none of the steps below apply
+	if requestType == RequestTypeModerations {
+		return rt
+	}
+
+	// Runs first so later steps only ever see well-formed JSON
+	if s.cfg.ValidateChunks {
+		rt.frames = append(rt.frames, s.dropInvalidFrame)
+	}
+	if requestType == RequestTypeChatToCompletions {
+		rt.body = append(rt.body, wrapCompletionAsChat)
+		rt.frames = append(rt.frames, newCompletionChunkWrapper())
+	}
+	if s.cfg.ChatMaxChoices > 0 && requestType != RequestTypeCodex {
+		rt.body = append(rt.body, s.limitChoices)
+		rt.frames = append(rt.frames, s.limitChoices)
+	}
+	if s.cfg.EnsureResponseID {
+		setID := newResponseIDSetter(requestType)
+		rt.body = append(rt.body, setID)
+		rt.frames = append(rt.frames, setID)
+	}
+	if s.cfg.MapFinishReasons {
+		rt.body = append(rt.body, s.normalizeFinishReasons)
+		rt.frames = append(rt.frames, s.normalizeFinishReasons)
+	}
+	if s.cfg.StreamMaxChars > 0 {
+		rt.frames = append(rt.frames, s.newStreamCharCap(rt, requestType))
+	}
+	if s.cfg.RewriteURLs {
+		rewrite := s.newURLRewriter(c)
+		rt.body = append(rt.body, rewrite)
+		rt.frames = append(rt.frames, rewrite)
+	}
+	if requestType == RequestTypeCodex && s.ensureNewlineFor(c.GetString(ContextKeyModel)) {
+		rt.body = append(rt.body, s.appendTrailingNewline)
+		tracker := newTrailingNewlineTracker(s.cfg.CodexTextPath)
+		rt.frames = append(rt.frames, tracker.observe)
+		rt.tails = append(rt.tails, tracker.tail)
+	}
+
+	return rt
+}
+
+// normalizeFinishReasons rewrites every choice's finish_reason found in FinishReasonMap.
+// It handles both full responses and stream chunks.
+func (s *ProxyService) normalizeFinishReasons(payload []byte) ([]byte, error) {
+	var err error
+	for i, choice := range gjson.GetBytes(payload, "choices").Array() {
+		reason := choice.Get("finish_reason")
+		if reason.Type != gjson.String {
+			continue
+		}
+		normalized, ok := s.cfg.FinishReasonMap[reason.Str]
+		if !ok || normalized == reason.Str {
+			continue
+		}
+		if payload, err = sjson.SetBytes(payload, "choices."+strconv.Itoa(i)+".finish_reason", normalized); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// limitChoices removes the choices whose index reaches ChatMaxChoices, for upstreams that
+// ignore `n`. A stream frame left without choices is dropped.
+func (s *ProxyService) limitChoices(payload []byte) ([]byte, error) {
+	choices := gjson.GetBytes(payload, "choices").Array()
+	kept := make([]string, 0, len(choices))
+	for i, choice := range choices {
+		index := i
+		if value := choice.Get("index"); value.Exists() {
+			index = int(value.Int())
+		}
+		if index < s.cfg.ChatMaxChoices {
+			kept = append(kept, choice.Raw)
+		}
+	}
+	if len(kept) == len(choices) {
+		return payload, nil
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return sjson.SetRawBytes(payload, "choices", []byte("["+strings.Join(kept, ",")+"]"))
+}
+
+// newResponseIDSetter returns a transform that adds a generated `id` to payloads without one
+// or with an empty one, for strict clients. The id is generated once, so every frame of a
+// stream shares it.
+func newResponseIDSetter(requestType string) func(payload []byte) ([]byte, error) {
+	prefix := "chatcmpl-"
+	if requestType == RequestTypeCodex {
+		prefix = "cmpl-"
+	}
+	id := prefix + newRequestID()
+	return func(payload []byte) ([]byte, error) {
+		if gjson.GetBytes(payload, "id").String() != "" {
+			return payload, nil
+		}
+		return sjson.SetBytes(payload, "id", id)
+	}
+}
+
+// dropInvalidFrame drops and logs a streamed frame whose payload is not valid JSON.
+func (s *ProxyService) dropInvalidFrame(payload []byte) ([]byte, error) {
+	if !gjson.ValidBytes(payload) {
+		s.log.Warnf("Dropped invalid stream frame from upstream: %q", payload)
+		return nil, nil
+	}
+	return payload, nil
+}
+
+// newStreamCharCap counts the streamed completion text and, once StreamMaxChars is reached,
+// cuts the current frame, marks its choices finished with "length" and stops the stream.
+func (s *ProxyService) newStreamCharCap(rt *responseTransforms, requestType string) frameTransform {
+	textPath := s.cfg.CodexTextPath
+	if requestType != RequestTypeCodex {
+		textPath = ChatStreamContentPath
+	}
+	arrayPath, itemPath, ok := splitChoicePath(textPath)
+	if !ok {
+		arrayPath, itemPath = "choices", "text"
+	}
+
+	remaining := s.cfg.StreamMaxChars
+	return func(payload []byte) ([]byte, error) {
+		var err error
+		for i, choice := range gjson.GetBytes(payload, arrayPath).Array() {
+			text := choice.Get(itemPath).String()
+			n := utf8.RuneCountInString(text)
+			if n == 0 {
+				continue
+			}
+			if n <= remaining {
+				remaining -= n
+				continue
+			}
+
+			prefix := arrayPath + "." + strconv.Itoa(i) + "."
+			if payload, err = sjson.SetBytes(payload, prefix+itemPath, string([]rune(text)[:remaining])); err != nil {
+				return nil, err
+			}
+			if payload, err = sjson.SetBytes(payload, prefix+"finish_reason", "length"); err != nil {
+				return nil, err
+			}
+			remaining = 0
+			rt.stopped = true
+		}
+		if rt.stopped {
+			s.log.Warnf("Stream exceeded %d output chars, truncated", s.cfg.StreamMaxChars)
+		}
+		return payload, nil
+	}
+}
+
+// newURLRewriter replaces the upstream origins in a response with ldor's public origin,
+// which is PublicBaseURL or else derived from the client request.
+func (s *ProxyService) newURLRewriter(c *gin.Context) func(payload []byte) ([]byte, error) {
+	public := strings.TrimSuffix(s.cfg.PublicBaseURL, "/")
+	if public == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		public = scheme + "://" + c.Request.Host
+	}
+
+	var replacements []string
+	for _, base := range []string{s.cfg.ChatAPIBaseURL, s.cfg.CodexAPIBaseURL} {
+		if u, err := url.Parse(base); err == nil && u.Host != "" {
+			replacements = append(replacements, u.Scheme+"://"+u.Host, public)
+		}
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	return func(payload []byte) ([]byte, error) {
+		return []byte(replacer.Replace(string(payload))), nil
+	}
+}
+
+// defaultContentFilterPatterns match the content-filter errors of OpenAI and Azure OpenAI.
+var defaultContentFilterPatterns = []string{"content_filter", "content_policy_violation", "content management policy"}
+
+// isContentFilterError reports whether an upstream error response is a content-filter
+// rejection according to FilterStatuses and FilterPatterns.
+func (s *ProxyService) isContentFilterError(status int, body []byte) bool {
+	statusMatched := false
+	for _, filterStatus := range s.cfg.FilterStatuses {
+		if status == filterStatus {
+			statusMatched = true
+			break
+		}
+	}
+	if !statusMatched {
+		return false
+	}
+
+	lowerBody := strings.ToLower(string(body))
+	for _, pattern := range s.cfg.FilterPatterns {
+		if strings.Contains(lowerBody, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// respondWithEmptyCompletion answers with a successful completion without choices, as a
+// single JSON body or as an event stream holding only the [DONE] frame.
+func respondWithEmptyCompletion(c *gin.Context, requestType string) {
+	if c.GetBool(ContextKeyStream) {
+		c.Data(http.StatusOK, "text/event-stream", []byte("data: [DONE]\n\n"))
+		return
+	}
+
+	object := "text_completion"
+	if requestType != RequestTypeCodex {
+		object = "chat.completion"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":  object,
+		"created": time.Now().Unix(),
+		"model":   c.GetString(ContextKeyModel),
+		"choices": []gin.H{},
+	})
+}
+
+// ensureNewlineFor reports whether code completions of model must end with a newline.
+func (s *ProxyService) ensureNewlineFor(model string) bool {
+	if !s.cfg.CodexEnsureNewline {
+		return false
+	}
+	if len(s.cfg.CodexNewlineModels) == 0 {
+		return true
+	}
+	for _, m := range s.cfg.CodexNewlineModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// appendTrailingNewline appends a newline to every non-empty completion text missing one.
+func (s *ProxyService) appendTrailingNewline(body []byte) ([]byte, error) {
+	return rewriteCompletionTexts(body, s.cfg.CodexTextPath, func(text string) string {
+		if text == "" || strings.HasSuffix(text, "\n") {
+			return text
+		}
+		return text + "\n"
+	})
+}
+
+// trailingNewlineTracker remembers whether the streamed text of each choice ended with a
+// newline, and emits a final chunk adding the newline where it is missing.
+type trailingNewlineTracker struct {
+	arrayPath string
+	itemPath  string
+	last      []byte
+	pending   map[int64]bool
+	order     []int64
+}
+
+func newTrailingNewlineTracker(textPath string) *trailingNewlineTracker {
+	arrayPath, itemPath, ok := splitChoicePath(textPath)
+	if !ok {
+		arrayPath, itemPath = "choices", "text"
+	}
+	return &trailingNewlineTracker{arrayPath: arrayPath, itemPath: itemPath, pending: make(map[int64]bool)}
+}
+
+func (t *trailingNewlineTracker) observe(payload []byte) ([]byte, error) {
+	t.last = payload
+	for _, choice := range gjson.GetBytes(payload, t.arrayPath).Array() {
+		text := choice.Get(t.itemPath).String()
+		if text == "" {
+			continue
+		}
+		index := choice.Get("index").Int()
+		if _, seen := t.pending[index]; !seen {
+			t.order = append(t.order, index)
+		}
+		t.pending[index] = !strings.HasSuffix(text, "\n")
+	}
+	return payload, nil
+}
+
+func (t *trailingNewlineTracker) tail() ([]byte, error) {
+	choices := make([]string, 0, len(t.order))
+	for _, index := range t.order {
+		if !t.pending[index] {
+			continue
+		}
+		choice, err := sjson.Set(`{"index":`+strconv.FormatInt(index, 10)+`}`, t.itemPath, "\n")
+		if err != nil {
+			return nil, err
+		}
+		if choice, err = sjson.Set(choice, "finish_reason", nil); err != nil {
+			return nil, err
+		}
+		choices = append(choices, choice)
+	}
+	if len(choices) == 0 || t.last == nil {
+		return nil, nil
+	}
+	payload, err := sjson.DeleteBytes(t.last, "usage")
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(payload, t.arrayPath, []byte("["+strings.Join(choices, ",")+"]"))
+}
+
+func (rt *responseTransforms) applyBody(body []byte) ([]byte, error) {
+	var err error
+	for _, transform := range rt.body {
+		if body, err = transform(body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func (rt *responseTransforms) applyFrame(payload []byte) ([]byte, error) {
+	var err error
+	for _, transform := range rt.frames {
+		if payload, err = transform(payload); err != nil || payload == nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+var (
+	sseDataPrefix = []byte("data:")
+	sseDone       = []byte("[DONE]")
+)
+
+// transformLine applies the frame transforms to a `data:` line of an event stream. Other
+// lines and the terminal [DONE] frame are returned unchanged, dropped frames return nil.
+func (rt *responseTransforms) transformLine(line []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(line, "\r\n")
+	if !bytes.HasPrefix(trimmed, sseDataPrefix) {
+		return line, nil
+	}
+	payload := bytes.TrimSpace(trimmed[len(sseDataPrefix):])
+	if bytes.Equal(payload, sseDone) {
+		rt.sawDone = true
+		return rt.prependTails(line)
+	}
+
+	payload, err := rt.applyFrame(payload)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	return append(append([]byte("data: "), payload...), '\n'), nil
+}
+
+// finish returns the frames closing a stream that was stopped early or ended without [DONE].
+func (rt *responseTransforms) finish() ([]byte, error) {
+	return rt.prependTails([]byte("data: [DONE]\n\n"))
+}
+
+// prependTails emits the stream tail frames in front of the terminal [DONE] line.
+func (rt *responseTransforms) prependTails(done []byte) ([]byte, error) {
+	var out []byte
+	for _, tail := range rt.tails {
+		payload, err := tail()
+		if err != nil {
+			return done, err
+		}
+		if payload != nil {
+			out = append(append(append(out, "data: "...), payload...), "\n\n"...)
+		}
+	}
+	return append(out, done...), nil
+}
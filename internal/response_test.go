@@ -0,0 +1,459 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func newTestContext() *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	return c
+}
+
+func TestEnsureResponseID(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestType string
+		body        string
+		wantPrefix  string
+		wantID      string
+	}{
+		{
+			name:        "chat response without id",
+			requestType: RequestTypeChat,
+			body:        `{"object":"chat.completion","choices":[]}`,
+			wantPrefix:  "chatcmpl-",
+		},
+		{
+			name:        "chat response with empty id",
+			requestType: RequestTypeChat,
+			body:        `{"id":"","object":"chat.completion","choices":[]}`,
+			wantPrefix:  "chatcmpl-",
+		},
+		{
+			name:        "upstream id is kept",
+			requestType: RequestTypeChat,
+			body:        `{"id":"chatcmpl-upstream","choices":[]}`,
+			wantID:      "chatcmpl-upstream",
+		},
+		{
+			name:        "codex response without id",
+			requestType: RequestTypeCodex,
+			body:        `{"choices":[{"text":"x","index":0}]}`,
+			wantPrefix:  "cmpl-",
+		},
+		{
+			name:        "chat to completions without id",
+			requestType: RequestTypeChatToCompletions,
+			body:        `{"object":"text_completion","choices":[{"text":"hi","index":0,"finish_reason":"stop"}]}`,
+			wantPrefix:  "chatcmpl-",
+		},
+		{
+			name:        "chat to completions keeps the upstream id",
+			requestType: RequestTypeChatToCompletions,
+			body:        `{"id":"cmpl-upstream","choices":[{"text":"hi","index":0,"finish_reason":"stop"}]}`,
+			wantID:      "cmpl-upstream",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{EnsureResponseID: true, CodexTextPath: "choices.#.text"})
+			out, err := s.newResponseTransforms(newTestContext(), tt.requestType).applyBody([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("applyBody() error = %v", err)
+			}
+			id := gjson.GetBytes(out, "id").String()
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("id = %q, want %q", id, tt.wantID)
+			}
+			if tt.wantPrefix != "" && (!strings.HasPrefix(id, tt.wantPrefix) || len(id) == len(tt.wantPrefix)) {
+				t.Errorf("id = %q, want a generated id with prefix %q", id, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestEnsureResponseIDStream(t *testing.T) {
+	s := newTestService(t, &ServiceConfig{EnsureResponseID: true})
+	rt := s.newResponseTransforms(newTestContext(), RequestTypeChatToCompletions)
+
+	var ids []string
+	for _, frame := range []string{`{"choices":[{"text":"a","index":0}]}`, `{"choices":[{"text":"b","index":0}]}`} {
+		out, err := rt.applyFrame([]byte(frame))
+		if err != nil {
+			t.Fatalf("applyFrame() error = %v", err)
+		}
+		ids = append(ids, gjson.GetBytes(out, "id").String())
+	}
+	if !strings.HasPrefix(ids[0], "chatcmpl-") || ids[0] != ids[1] {
+		t.Errorf("frame ids = %q, want one shared generated id", ids)
+	}
+}
+
+func TestNormalizeFinishReasons(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		payload string
+		want    []string
+	}{
+		{
+			name:    "disabled",
+			cfg:     &ServiceConfig{},
+			payload: `{"choices":[{"text":"a","finish_reason":"eos"}]}`,
+			want:    []string{"eos"},
+		},
+		{
+			name:    "default map",
+			cfg:     &ServiceConfig{MapFinishReasons: true},
+			payload: `{"choices":[{"text":"a","finish_reason":"end_turn"},{"text":"b","finish_reason":"max_tokens"},{"text":"c","finish_reason":"stop"}]}`,
+			want:    []string{"stop", "length", "stop"},
+		},
+		{
+			name:    "custom mapping",
+			cfg:     &ServiceConfig{MapFinishReasons: true, FinishReasonMap: map[string]string{"safety": "content_filter"}},
+			payload: `{"choices":[{"text":"a","finish_reason":"safety"},{"text":"b","finish_reason":"eos"}]}`,
+			want:    []string{"content_filter", "stop"},
+		},
+		{
+			name:    "unknown and null reasons kept",
+			cfg:     &ServiceConfig{MapFinishReasons: true},
+			payload: `{"choices":[{"text":"a","finish_reason":"tool_calls"},{"text":"b","finish_reason":null}]}`,
+			want:    []string{"tool_calls", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, tt.cfg)
+			rt := s.newResponseTransforms(newTestContext(), RequestTypeCodex)
+
+			body, err := rt.applyBody([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("applyBody() error = %v", err)
+			}
+			frame, err := rt.applyFrame([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("applyFrame() error = %v", err)
+			}
+
+			for mode, out := range map[string][]byte{"buffered": body, "streaming": frame} {
+				for i, want := range tt.want {
+					if got := gjson.GetBytes(out, "choices."+strconv.Itoa(i)+".finish_reason").String(); got != want {
+						t.Errorf("%s finish_reason %d = %q, want %q", mode, i, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureTrailingNewline(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		body    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name:    "disabled",
+			cfg:     &ServiceConfig{},
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"index":0,"text":"return x"}]}`),
+			want:    `"text":"return x"}`,
+		},
+		{
+			name:    "absent newline appended",
+			cfg:     &ServiceConfig{CodexEnsureNewline: true},
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"index":0,"text":"return x"}]}`),
+			want:    `"text":"return x\n"}`,
+		},
+		{
+			name:    "present newline kept",
+			cfg:     &ServiceConfig{CodexEnsureNewline: true},
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"index":0,"text":"return x\n"}]}`),
+			want:    `"text":"return x\n"}`,
+		},
+		{
+			name:    "model not listed",
+			cfg:     &ServiceConfig{CodexEnsureNewline: true, CodexNewlineModels: []string{"other-model"}},
+			body:    `{"prompt":"p"}`,
+			handler: respondJSON(http.StatusOK, `{"choices":[{"index":0,"text":"return x"}]}`),
+			want:    `"text":"return x"}`,
+		},
+		{
+			name:    "final streamed chunk",
+			cfg:     &ServiceConfig{CodexEnsureNewline: true},
+			body:    `{"prompt":"p","stream":true}`,
+			handler: respondEvents([]string{`{"choices":[{"index":0,"text":"return"}]}`, `{"choices":[{"index":0,"text":" x"}]}`}, false),
+			want:    `"text":"\n","finish_reason":null}]}` + "\n\ndata: [DONE]",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, tt.cfg, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", tt.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseURLs(t *testing.T) {
+	cfg := &ServiceConfig{
+		RewriteURLs:     true,
+		ChatAPIBaseURL:  "https://api.openai.com/v1",
+		CodexAPIBaseURL: "https://codex.example.com",
+	}
+	tests := []struct {
+		name      string
+		publicURL string
+		forwarded string
+		payload   string
+		want      string
+	}{
+		{
+			name:    "request host",
+			payload: `{"error":{"message":"see https://api.openai.com/docs"}}`,
+			want:    `{"error":{"message":"see http://ldor.local/docs"}}`,
+		},
+		{
+			name:      "forwarded https",
+			forwarded: "https",
+			payload:   `{"url":"https://codex.example.com/models/m"}`,
+			want:      `{"url":"https://ldor.local/models/m"}`,
+		},
+		{
+			name:      "configured public URL",
+			publicURL: "https://proxy.example.org/",
+			payload:   `{"a":"https://api.openai.com/x","b":"https://codex.example.com/y"}`,
+			want:      `{"a":"https://proxy.example.org/x","b":"https://proxy.example.org/y"}`,
+		},
+		{
+			name:    "other hosts untouched",
+			payload: `{"url":"https://example.com/api.openai.com"}`,
+			want:    `{"url":"https://example.com/api.openai.com"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *cfg
+			config.PublicBaseURL = tt.publicURL
+			c := newTestContext()
+			c.Request.Host = "ldor.local"
+			if tt.forwarded != "" {
+				c.Request.Header.Set("X-Forwarded-Proto", tt.forwarded)
+			}
+
+			out, err := newTestService(t, &config).newURLRewriter(c)([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("rewrite error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("payload = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsContentFilterError(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    *ServiceConfig
+		status int
+		body   string
+		want   bool
+	}{
+		{name: "openai filter", cfg: &ServiceConfig{}, status: http.StatusBadRequest, body: `{"error":{"code":"content_filter"}}`, want: true},
+		{name: "azure filter", cfg: &ServiceConfig{}, status: http.StatusBadRequest, body: `{"error":{"message":"blocked by the Content Management Policy"}}`, want: true},
+		{name: "other error", cfg: &ServiceConfig{}, status: http.StatusBadRequest, body: `{"error":{"code":"invalid_request"}}`},
+		{name: "status not listed", cfg: &ServiceConfig{}, status: http.StatusForbidden, body: `{"error":{"code":"content_filter"}}`},
+		{
+			name:   "custom status and pattern",
+			cfg:    &ServiceConfig{FilterStatuses: []int{http.StatusForbidden}, FilterPatterns: []string{"blocked"}},
+			status: http.StatusForbidden,
+			body:   `{"error":"Blocked"}`,
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDefaultTestService(t, tt.cfg)
+			if got := s.isContentFilterError(tt.status, []byte(tt.body)); got != tt.want {
+				t.Errorf("isContentFilterError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoftContentFilter(t *testing.T) {
+	t.Parallel()
+	filtered := respondJSON(http.StatusBadRequest, `{"error":{"code":"content_filter"}}`)
+	tests := []struct {
+		name       string
+		soft       bool
+		handler    http.HandlerFunc
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "disabled",
+			handler:    filtered,
+			path:       "/v1/chat/completions",
+			body:       `{"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "other error kept",
+			soft:       true,
+			handler:    respondJSON(http.StatusBadRequest, `{"error":{"code":"invalid_request"}}`),
+			path:       "/v1/chat/completions",
+			body:       `{"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty chat completion",
+			soft:       true,
+			handler:    filtered,
+			path:       "/v1/chat/completions",
+			body:       `{"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"object":"chat.completion"`,
+		},
+		{
+			name:       "empty code completion",
+			soft:       true,
+			handler:    filtered,
+			path:       "/v1/engines/copilot-codex/completions",
+			body:       `{"prompt":"p"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"object":"text_completion"`,
+		},
+		{
+			name:       "empty stream",
+			soft:       true,
+			handler:    filtered,
+			path:       "/v1/engines/copilot-codex/completions",
+			body:       `{"prompt":"p","stream":true}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "data: [DONE]",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{SoftContentFilter: tt.soft, DisableLocale: true}, tt.handler)
+
+			w := tp.do(http.MethodPost, tt.path, tt.body, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusOK && strings.Contains(w.Body.String(), `"choices":[{`) {
+				t.Errorf("body = %s, want no choices", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLimitChoices(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "within limit", payload: `{"choices":[{"index":0},{"index":1}]}`, want: `{"choices":[{"index":0},{"index":1}]}`},
+		{name: "extra choices removed", payload: `{"choices":[{"index":0},{"index":1},{"index":2}]}`, want: `{"choices":[{"index":0},{"index":1}]}`},
+		{name: "position without index", payload: `{"choices":[{"text":"a"},{"text":"b"},{"text":"c"}]}`, want: `{"choices":[{"text":"a"},{"text":"b"}]}`},
+		{name: "frame of an extra choice dropped", payload: `{"choices":[{"index":3,"delta":{}}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newTestService(t, &ServiceConfig{ChatMaxChoices: 2}).limitChoices([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("limitChoices() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("payload = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatMaxChoices(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		stream    bool
+		handler   http.HandlerFunc
+		wantCount int
+	}{
+		{
+			name:      "buffered",
+			handler:   respondJSON(http.StatusOK, `{"choices":[{"index":0,"message":{"content":"a"}},{"index":1,"message":{"content":"b"}},{"index":2,"message":{"content":"c"}}]}`),
+			wantCount: 2,
+		},
+		{
+			name:   "stream",
+			stream: true,
+			handler: respondEvents([]string{
+				`{"choices":[{"index":0,"delta":{"content":"a"}}]}`,
+				`{"choices":[{"index":1,"delta":{"content":"b"}}]}`,
+				`{"choices":[{"index":2,"delta":{"content":"c"}}]}`,
+			}, false),
+			wantCount: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ChatMaxChoices: 2, DisableLocale: true}, tt.handler)
+
+			body := `{"n":5,"stream":` + strconv.FormatBool(tt.stream) + `,"messages":[{"role":"user","content":"hi"}]}`
+			w := tp.do(http.MethodPost, "/v1/chat/completions", body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if _, upstream := tp.lastUpstream(t); gjson.GetBytes(upstream, "n").Int() != 2 {
+				t.Errorf("upstream n = %s, want 2", gjson.GetBytes(upstream, "n").Raw)
+			}
+			if got := strings.Count(w.Body.String(), `"index":`); got != tt.wantCount {
+				t.Errorf("choices = %d, want %d: %s", got, tt.wantCount, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), `"c"`) {
+				t.Errorf("body = %s, want the third choice removed", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shengyanli1982/retry"
+	"github.com/tidwall/gjson"
+)
+
+const DefaultRetryInitDelay = 500 * time.Millisecond
+
+var (
+	ErrorUpstreamRateLimited = errors.New("upstream rate limited")
+	ErrorEmptyCompletion     = errors.New("upstream returned an empty completion")
+	ErrorUpstreamServerError = errors.New("upstream server error")
+)
+
+// retryState carries per-request retry information between attempts.
+type retryState struct {
+	retryAfter time.Duration
+	deadline   time.Time
+	// categoryRetries counts the retries spent per error category
+	categoryRetries map[string]int
+}
+
+// retryCategory classifies err into one of the retry_max_attempts_by_category categories,
+// errors outside them return an empty category. A first byte timeout is not a timeout
+// category, it is never retried.
+func retryCategory(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrorUpstreamRateLimited):
+		return RetryCategory429
+	case errors.Is(err, ErrorUpstreamServerError):
+		return RetryCategory5xx
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return RetryCategoryTimeout
+	case errors.As(err, &netErr):
+		return RetryCategoryConnection
+	}
+	return ""
+}
+
+// retryAllowed reports whether err may be retried under RetryCategoryLimits. Categories
+// without a limit are only bound by the global attempt cap, a first byte timeout fails fast.
+func (s *ProxyService) retryAllowed(state *retryState, err error) bool {
+	if errors.Is(err, ErrorFirstByteTimeout) {
+		return false
+	}
+	category := retryCategory(err)
+	limit, ok := s.cfg.RetryCategoryLimits[category]
+	if !ok {
+		return true
+	}
+	if state.categoryRetries == nil {
+		state.categoryRetries = make(map[string]int)
+	}
+	state.categoryRetries[category]++
+	return state.categoryRetries[category] <= limit
+}
+
+// jitterBackOff returns the random part of the retry backoff, capped to RetryMaxJitterMs.
+func (s *ProxyService) jitterBackOff() retry.BackoffFunc {
+	if s.cfg.RetryMaxJitterMs <= 0 {
+		return retry.RandomBackOff
+	}
+	maxJitter := time.Duration(s.cfg.RetryMaxJitterMs) * time.Millisecond
+	return func(n int64) time.Duration {
+		return min(retry.RandomBackOff(n), maxJitter)
+	}
+}
+
+// newRetrier creates a retrier bound to ctx whose backoff honors the Retry-After recorded in state.
+func (s *ProxyService) newRetrier(ctx context.Context, state *retryState) *retry.Retry {
+	defaultBackoff := retry.CombineBackOffs(retry.ExponentialBackOff, s.jitterBackOff())
+
+	cfg := retry.NewConfig().
+		WithContext(ctx).
+		WithCallback(s.retryCb).
+		WithInitDelay(DefaultRetryInitDelay).
+		WithDetail(true).
+		WithRetryIfFunc(func(err error) bool {
+			return s.retryAllowed(state, err)
+		}).
+		WithBackOffFunc(func(n int64) time.Duration {
+			if state.retryAfter <= 0 {
+				return defaultBackoff(n)
+			}
+			// The retrier adds the init delay on top of the backoff
+			delay := state.retryAfter - DefaultRetryInitDelay
+			if remaining := time.Until(state.deadline) - DefaultRetryInitDelay; delay > remaining {
+				delay = remaining
+			}
+			if delay < 0 {
+				delay = 0
+			}
+			return delay
+		})
+
+	return retry.New(cfg)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP-date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := at.Sub(now); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// cloneRequestWithBody returns a copy of req with a fresh body, so it can be sent again.
+func cloneRequestWithBody(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// isEmptyCompletion buffers the response body and reports whether every choice in it is
+// empty. The body of resp is replaced so it can still be forwarded.
+func (s *ProxyService) isEmptyCompletion(resp *http.Response, requestType string) (bool, error) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return isEmptyCompletionBody(body, s.completionTextPath(requestType)), nil
+}
+
+// isEmptyCompletionBody reports whether every choice of a response body is empty. A choice
+// only counts as empty when its text is blank, it calls no tool or function and it finished
+// with stop or length, so tool calls with a null content are not retried.
+func isEmptyCompletionBody(body []byte, path string) bool {
+	arrayPath, itemPath, ok := splitChoicePath(path)
+	if !ok {
+		for _, text := range completionTexts(body, path) {
+			if strings.TrimSpace(text) != "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, choice := range gjson.GetBytes(body, arrayPath).Array() {
+		if strings.TrimSpace(choice.Get(itemPath).String()) != "" {
+			return false
+		}
+		if choice.Get("message.tool_calls.0").Exists() || choice.Get("message.function_call").IsObject() {
+			return false
+		}
+		if reason := choice.Get("finish_reason").String(); reason != "stop" && reason != "length" {
+			return false
+		}
+	}
+	return true
+}
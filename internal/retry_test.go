@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsEmptyCompletionBody(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want bool
+	}{
+		{
+			name: "blank chat content",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":"  "},"finish_reason":"stop"}]}`,
+			want: true,
+		},
+		{
+			name: "truncated by length",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":""},"finish_reason":"length"}]}`,
+			want: true,
+		},
+		{
+			name: "chat content",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"}]}`,
+			want: false,
+		},
+		{
+			name: "tool call with null content",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			want: false,
+		},
+		{
+			name: "tool call finished with stop",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":null,"tool_calls":[{"id":"call_1"}]},"finish_reason":"stop"}]}`,
+			want: false,
+		},
+		{
+			name: "function call with null content",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":null,"function_call":{"name":"f","arguments":"{}"}},"finish_reason":"function_call"}]}`,
+			want: false,
+		},
+		{
+			name: "content filtered",
+			path: "choices.#.message.content",
+			body: `{"choices":[{"message":{"content":""},"finish_reason":"content_filter"}]}`,
+			want: false,
+		},
+		{
+			name: "one choice with text",
+			path: "choices.#.text",
+			body: `{"choices":[{"text":"","finish_reason":"stop"},{"text":"x","finish_reason":"stop"}]}`,
+			want: false,
+		},
+		{
+			name: "plain path",
+			path: "output",
+			body: `{"output":""}`,
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isEmptyCompletionBody([]byte(tt.body), tt.path); got != tt.want {
+				t.Errorf("isEmptyCompletionBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "missing", value: "", want: 0},
+		{name: "seconds", value: " 3 ", want: 3 * time.Second},
+		{name: "negative seconds", value: "-1", want: 0},
+		{name: "http date", value: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second},
+		{name: "date in the past", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "garbage", value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	tp := newTestProxy(t, &ServiceConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		respondJSON(http.StatusOK, `{"choices":[{"text":"ok"}]}`)(w, r)
+	})
+
+	start := time.Now()
+	w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"x"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the 1s Retry-After", elapsed)
+	}
+	if got := tp.upstreamCalls(); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
+
+func TestJitterBackOffCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxMs    int
+		wantMax  time.Duration
+		attempts int64
+	}{
+		{name: "capped", maxMs: 50, wantMax: 50 * time.Millisecond, attempts: 20},
+		{name: "cap above the jitter", maxMs: 10000, wantMax: 10 * time.Second, attempts: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jitter := newTestService(t, &ServiceConfig{RetryMaxJitterMs: tt.maxMs}).jitterBackOff()
+			for n := int64(1); n <= tt.attempts; n++ {
+				for i := 0; i < 100; i++ {
+					if got := jitter(n); got < 0 || got > tt.wantMax {
+						t.Fatalf("jitter(%d) = %v, want within [0, %v]", n, got, tt.wantMax)
+					}
+				}
+			}
+		})
+	}
+
+	// Without a cap the jitter grows with the attempt number
+	uncapped := newTestService(t, &ServiceConfig{}).jitterBackOff()
+	var largest time.Duration
+	for i := 0; i < 100; i++ {
+		largest = max(largest, uncapped(1000))
+	}
+	if largest <= 50*time.Millisecond {
+		t.Errorf("uncapped jitter stayed within %v", largest)
+	}
+}
+
+func TestRetryCategory(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "rate limited", err: ErrorUpstreamRateLimited, want: RetryCategory429},
+		{name: "server error", err: ErrorUpstreamServerError, want: RetryCategory5xx},
+		{name: "deadline", err: fmt.Errorf("request: %w", context.DeadlineExceeded), want: RetryCategoryTimeout},
+		{name: "network timeout", err: &net.DNSError{IsTimeout: true}, want: RetryCategoryTimeout},
+		{name: "first byte timeout", err: ErrorFirstByteTimeout},
+		{name: "connection", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: RetryCategoryConnection},
+		{name: "other", err: errors.New("boom")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryCategory(tt.err); got != tt.want {
+				t.Errorf("retryCategory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAllowed(t *testing.T) {
+	s := newTestService(t, &ServiceConfig{RetryCategoryLimits: map[string]int{RetryCategory429: 2, RetryCategory5xx: 0}})
+	state := &retryState{}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "first 429", err: ErrorUpstreamRateLimited, want: true},
+		{name: "second 429", err: ErrorUpstreamRateLimited, want: true},
+		{name: "429 limit spent", err: ErrorUpstreamRateLimited},
+		{name: "5xx not retried", err: ErrorUpstreamServerError},
+		{name: "category without a limit", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "first byte timeout", err: fmt.Errorf("read: %w", ErrorFirstByteTimeout)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.retryAllowed(state, tt.err); got != tt.want {
+				t.Errorf("retryAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		limits    map[string]int
+		wantCalls int
+	}{
+		{name: "not retried by default", wantCalls: 1},
+		{name: "retried up to the category limit", limits: map[string]int{RetryCategory5xx: 1}, wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{RetryCategoryLimits: tt.limits}, respondJSON(http.StatusBadGateway, `{"error":"down"}`))
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"x"}`, nil)
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+			}
+			if got := tp.upstreamCalls(); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// requestSchema is the subset of JSON Schema used to validate incoming requests.
+type requestSchema struct {
+	Type       schemaTypes               `json:"type,omitempty"`
+	Required   []string                  `json:"required,omitempty"`
+	Properties map[string]*requestSchema `json:"properties,omitempty"`
+	Items      *requestSchema            `json:"items,omitempty"`
+	Enum       []string                  `json:"enum,omitempty"`
+	MinItems   *int                      `json:"minItems,omitempty"`
+	Minimum    *float64                  `json:"minimum,omitempty"`
+	Maximum    *float64                  `json:"maximum,omitempty"`
+}
+
+// schemaTypes accepts both a single type name and a list of type names.
+type schemaTypes []string
+
+func (st *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*st = schemaTypes{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*st = multiple
+	return nil
+}
+
+var (
+	chatRequestSchema = mustLoadSchema("schemas/chat_completions.json")
+	codeRequestSchema = mustLoadSchema("schemas/completions.json")
+)
+
+func mustLoadSchema(name string) *requestSchema {
+	content, err := schemaFiles.ReadFile(name)
+	if err != nil {
+		panic(fmt.Sprintf("failed to read schema %s: %v", name, err))
+	}
+	schema := &requestSchema{}
+	if err := json.Unmarshal(content, schema); err != nil {
+		panic(fmt.Sprintf("failed to unmarshal schema %s: %v", name, err))
+	}
+	return schema
+}
+
+// validateRequestBody checks body against schema and returns every violation found.
+func validateRequestBody(schema *requestSchema, body []byte) []string {
+	if !gjson.ValidBytes(body) {
+		return []string{"body: invalid JSON"}
+	}
+	return schema.validate("body", gjson.ParseBytes(body), nil)
+}
+
+func (rs *requestSchema) validate(path string, value gjson.Result, violations []string) []string {
+	if len(rs.Type) > 0 && !rs.matchesType(value) {
+		return append(violations, fmt.Sprintf("%s: expected type %v", path, []string(rs.Type)))
+	}
+
+	if len(rs.Enum) > 0 && value.Type == gjson.String {
+		matched := false
+		for _, allowed := range rs.Enum {
+			if value.Str == allowed {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violations = append(violations, fmt.Sprintf("%s: value %q is not one of %v", path, value.Str, rs.Enum))
+		}
+	}
+
+	if value.Type == gjson.Number {
+		if rs.Minimum != nil && value.Num < *rs.Minimum {
+			violations = append(violations, fmt.Sprintf("%s: value %v is less than minimum %v", path, value.Num, *rs.Minimum))
+		}
+		if rs.Maximum != nil && value.Num > *rs.Maximum {
+			violations = append(violations, fmt.Sprintf("%s: value %v is greater than maximum %v", path, value.Num, *rs.Maximum))
+		}
+	}
+
+	if value.IsObject() {
+		for _, key := range rs.Required {
+			if !value.Get(gjson.Escape(key)).Exists() {
+				violations = append(violations, fmt.Sprintf("%s.%s: field is required", path, key))
+			}
+		}
+		keys := make([]string, 0, len(rs.Properties))
+		for key := range rs.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if field := value.Get(gjson.Escape(key)); field.Exists() {
+				violations = rs.Properties[key].validate(path+"."+key, field, violations)
+			}
+		}
+	}
+
+	if value.IsArray() {
+		items := value.Array()
+		if rs.MinItems != nil && len(items) < *rs.MinItems {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %d items", path, *rs.MinItems))
+		}
+		if rs.Items != nil {
+			for i, item := range items {
+				violations = rs.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, violations)
+			}
+		}
+	}
+
+	return violations
+}
+
+func (rs *requestSchema) matchesType(value gjson.Result) bool {
+	for _, t := range rs.Type {
+		switch t {
+		case "string":
+			if value.Type == gjson.String {
+				return true
+			}
+		case "number":
+			if value.Type == gjson.Number {
+				return true
+			}
+		case "integer":
+			if value.Type == gjson.Number && value.Num == math.Trunc(value.Num) {
+				return true
+			}
+		case "boolean":
+			if value.Type == gjson.True || value.Type == gjson.False {
+				return true
+			}
+		case "null":
+			if value.Type == gjson.Null {
+				return true
+			}
+		case "array":
+			if value.IsArray() {
+				return true
+			}
+		case "object":
+			if value.IsObject() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequestBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema *requestSchema
+		body   string
+		want   []string
+	}{
+		{
+			name:   "valid chat request",
+			schema: chatRequestSchema,
+			body:   `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"temperature":1,"max_tokens":null}`,
+		},
+		{
+			name:   "invalid JSON",
+			schema: chatRequestSchema,
+			body:   `{"messages":`,
+			want:   []string{"body: invalid JSON"},
+		},
+		{
+			name:   "missing messages",
+			schema: chatRequestSchema,
+			body:   `{"model":"gpt-4"}`,
+			want:   []string{"body.messages"},
+		},
+		{
+			name:   "empty messages",
+			schema: chatRequestSchema,
+			body:   `{"messages":[]}`,
+			want:   []string{"body.messages"},
+		},
+		{
+			name:   "unknown role and temperature out of range",
+			schema: chatRequestSchema,
+			body:   `{"messages":[{"role":"robot","content":"hi"}],"temperature":3}`,
+			want:   []string{"body.messages[0].role", "body.temperature"},
+		},
+		{
+			name:   "valid code request",
+			schema: codeRequestSchema,
+			body:   `{"prompt":"def f():","suffix":null,"logprobs":2}`,
+		},
+		{
+			name:   "code prompt of the wrong type",
+			schema: codeRequestSchema,
+			body:   `{"prompt":42}`,
+			want:   []string{"body.prompt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validateRequestBody(tt.schema, []byte(tt.body))
+			if len(got) != len(tt.want) {
+				t.Fatalf("violations = %q, want %d violations", got, len(tt.want))
+			}
+			for i, prefix := range tt.want {
+				if !strings.HasPrefix(got[i], prefix) {
+					t.Errorf("violation %d = %q, want prefix %q", i, got[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRequestsRejectsLocally(t *testing.T) {
+	tp := newTestProxy(t, &ServiceConfig{ValidateRequests: true}, respondJSON(http.StatusOK, `{}`))
+
+	w := tp.do(http.MethodPost, "/v1/chat/completions", `{"messages":[]}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "violations") {
+		t.Errorf("body = %s, want violations", w.Body.String())
+	}
+	if calls := tp.upstreamCalls(); calls != 0 {
+		t.Errorf("upstream calls = %d, want 0", calls)
+	}
+}
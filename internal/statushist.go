@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusHistogram counts upstream response statuses per route over a rolling window of
+// per-minute buckets.
+type statusHistogram struct {
+	mu      sync.Mutex
+	buckets []statusBucket
+}
+
+type statusBucket struct {
+	minute int64
+	counts map[statusKey]int
+}
+
+type statusKey struct {
+	route  string
+	status int
+}
+
+// StatusCount is the number of responses with Status seen on Route within the window.
+type StatusCount struct {
+	Route  string `json:"route"`
+	Status int    `json:"status"`
+	Count  int    `json:"count"`
+}
+
+func newStatusHistogram(windowMinutes int) *statusHistogram {
+	return &statusHistogram{buckets: make([]statusBucket, windowMinutes)}
+}
+
+func (sh *statusHistogram) record(route string, status int, now time.Time) {
+	minute := now.Unix() / 60
+	key := statusKey{route: route, status: status}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	bucket := &sh.buckets[minute%int64(len(sh.buckets))]
+	if bucket.minute != minute || bucket.counts == nil {
+		// The slot still holds a minute that has left the window
+		bucket.minute = minute
+		bucket.counts = make(map[statusKey]int)
+	}
+	bucket.counts[key]++
+}
+
+// snapshot sums the buckets still inside the window, sorted by route and status.
+func (sh *statusHistogram) snapshot(now time.Time) []StatusCount {
+	minute := now.Unix() / 60
+	totals := make(map[statusKey]int)
+
+	sh.mu.Lock()
+	for _, bucket := range sh.buckets {
+		if bucket.counts == nil || minute-bucket.minute >= int64(len(sh.buckets)) {
+			continue
+		}
+		for key, count := range bucket.counts {
+			totals[key] += count
+		}
+	}
+	sh.mu.Unlock()
+
+	counts := make([]StatusCount, 0, len(totals))
+	for key, count := range totals {
+		counts = append(counts, StatusCount{Route: key.route, Status: key.status, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Route != counts[j].Route {
+			return counts[i].Route < counts[j].Route
+		}
+		return counts[i].Status < counts[j].Status
+	})
+	return counts
+}
+
+func (ps *ProxyService) handleStatusHistogram(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"window_minutes": len(ps.statusHist.buckets),
+		"statuses":       ps.statusHist.snapshot(time.Now()),
+	})
+}
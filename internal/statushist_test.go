@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusHistogramWindow(t *testing.T) {
+	start := time.Unix(1_700_000_040, 0)
+	sh := newStatusHistogram(2)
+	sh.record(RequestTypeCodex, http.StatusOK, start)
+	sh.record(RequestTypeCodex, http.StatusOK, start)
+	sh.record(RequestTypeChat, http.StatusTooManyRequests, start.Add(time.Minute))
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want []StatusCount
+	}{
+		{
+			name: "both minutes in the window",
+			at:   start.Add(time.Minute),
+			want: []StatusCount{
+				{Route: RequestTypeChat, Status: http.StatusTooManyRequests, Count: 1},
+				{Route: RequestTypeCodex, Status: http.StatusOK, Count: 2},
+			},
+		},
+		{
+			name: "oldest minute expired",
+			at:   start.Add(2 * time.Minute),
+			want: []StatusCount{{Route: RequestTypeChat, Status: http.StatusTooManyRequests, Count: 1}},
+		},
+		{name: "everything expired", at: start.Add(3 * time.Minute), want: []StatusCount{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sh.snapshot(tt.at); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("snapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A reused slot drops the counts of the minute it held before
+	sh.record(RequestTypeCodex, http.StatusBadGateway, start.Add(2*time.Minute))
+	want := []StatusCount{
+		{Route: RequestTypeChat, Status: http.StatusTooManyRequests, Count: 1},
+		{Route: RequestTypeCodex, Status: http.StatusBadGateway, Count: 1},
+	}
+	if got := sh.snapshot(start.Add(2 * time.Minute)); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() after reuse = %v, want %v", got, want)
+	}
+}
+
+func TestStatusHistogramEndpoint(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantStatus int
+	}{
+		{name: "disabled", wantStatus: http.StatusNotFound},
+		{name: "enabled", enabled: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{StatusHistogram: tt.enabled, StatusHistogramMin: 5}
+			tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`))
+			tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p"}`, nil)
+
+			w := tp.do(http.MethodGet, "/admin/status-histogram", "", nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !tt.enabled {
+				return
+			}
+
+			var got struct {
+				WindowMinutes int           `json:"window_minutes"`
+				Statuses      []StatusCount `json:"statuses"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+			}
+			want := []StatusCount{{Route: RequestTypeCodex, Status: http.StatusOK, Count: 1}}
+			if got.WindowMinutes != 5 || !reflect.DeepEqual(got.Statuses, want) {
+				t.Errorf("histogram = %+v, want a 5 minute window with %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	ErrorFirstByteTimeout = errors.New("upstream first byte timeout")
+	ErrorStreamSlotsBusy  = errors.New("all stream slots are busy")
+)
+
+// acquireStreamSlot takes one of the MaxConcurrentStreams slots for a streaming request.
+// When all slots are busy the request waits in a queue of ConcurrencyQueueSize requests for
+// at most ConcurrencyQueueTimeoutMs, without a queue it fails right away with
+// ErrorStreamSlotsBusy. A client that goes away while queued gets the context error.
+// Buffered requests and an unlimited config always succeed.
+func (s *ProxyService) acquireStreamSlot(ctx context.Context, body []byte) (release func(), err error) {
+	if s.streamSlots == nil || !gjson.GetBytes(body, "stream").Bool() {
+		return func() {}, nil
+	}
+	release = func() { <-s.streamSlots }
+
+	select {
+	case s.streamSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if int(s.streamQueued.Add(1)) > s.cfg.ConcurrencyQueueSize {
+		s.streamQueued.Add(-1)
+		s.log.Warnf("All %d stream slots are in use, streaming request rejected", cap(s.streamSlots))
+		return nil, ErrorStreamSlotsBusy
+	}
+	s.metrics.streamQueueDepth.Inc()
+	defer func() {
+		s.streamQueued.Add(-1)
+		s.metrics.streamQueueDepth.Dec()
+	}()
+
+	timer := time.NewTimer(time.Duration(s.cfg.ConcurrencyQueueTimeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case s.streamSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		s.log.Warnf("Streaming request waited %dms for a stream slot, rejected", s.cfg.ConcurrencyQueueTimeoutMs)
+		return nil, ErrorStreamSlotsBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// firstByteTimer cancels an upstream request that sends no body byte within FirstByteTimeoutMs,
+// so the wait for response headers is bounded as well.
+type firstByteTimer struct {
+	timer  *time.Timer
+	cancel context.CancelFunc
+	fired  atomic.Bool
+}
+
+// withFirstByteTimeout returns a copy of req whose context is cancelled when timeout passes
+// before the first body byte arrives.
+func withFirstByteTimeout(req *http.Request, timeout time.Duration) (*http.Request, *firstByteTimer) {
+	ctx, cancel := context.WithCancel(req.Context())
+	t := &firstByteTimer{cancel: cancel}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+	return req.WithContext(ctx), t
+}
+
+// err reports a failure caused by the timer as ErrorFirstByteTimeout.
+func (t *firstByteTimer) err(err error) error {
+	if err != nil && t.fired.Load() {
+		return ErrorFirstByteTimeout
+	}
+	return err
+}
+
+// stop stops the timer of a response that is held rather than read, such as a 429 kept
+// across the Retry-After wait. A nil timer is ignored.
+func (t *firstByteTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// wrap stops the timer on the first byte of body and releases the request context on close.
+func (t *firstByteTimer) wrap(body io.ReadCloser) io.ReadCloser {
+	return &firstByteBody{ReadCloser: body, timer: t}
+}
+
+type firstByteBody struct {
+	io.ReadCloser
+	timer *firstByteTimer
+}
+
+func (b *firstByteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.timer.Stop()
+	}
+	return n, b.timer.err(err)
+}
+
+func (b *firstByteBody) Close() error {
+	b.timer.timer.Stop()
+	b.timer.cancel()
+	return b.ReadCloser.Close()
+}
+
+// readFirstChunk blocks until the first bytes of body arrive, surfacing a first byte timeout
+// before any response is written.
+func readFirstChunk(body io.Reader) ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	var n int
+	var err error
+	for n == 0 && err == nil {
+		n, err = body.Read(buf)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(strings.TrimSpace(contentType), "text/event-stream")
+}
+
+// copyStream forwards a streamed response, flushing after every chunk (or every event when
+// frame transforms are active) and recording the time to first byte and the gaps between flushes.
+func (s *ProxyService) copyStream(c *gin.Context, reader io.Reader, start time.Time, transforms *responseTransforms) error {
+	model := c.GetString(ContextKeyModel)
+	var last time.Time
+	flush := func() {
+		now := time.Now()
+		if last.IsZero() {
+			s.metrics.streamFirstByte.WithLabelValues(model).Observe(now.Sub(start).Seconds())
+		} else {
+			s.metrics.streamChunkGap.WithLabelValues(model).Observe(now.Sub(last).Seconds())
+		}
+		last = now
+		c.Writer.Flush()
+	}
+
+	// Detecting a missing [DONE] needs the line mode as well
+	if len(transforms.frames) == 0 && !s.cfg.SynthesizeDone {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+					return werr
+				}
+				flush()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	lines := bufio.NewReaderSize(reader, 64*1024)
+	for {
+		line, err := lines.ReadBytes('\n')
+		// A frame cut off by a broken upstream is dropped, the stream is closed below
+		if err != nil && !errors.Is(err, io.EOF) && s.cfg.SynthesizeDone {
+			line = nil
+		}
+		if len(line) > 0 {
+			out, terr := transforms.transformLine(line)
+			if terr != nil {
+				s.log.Errorf("Failed to transform stream frame, frame dropped: %v", terr)
+			}
+			if len(out) > 0 {
+				if _, werr := c.Writer.Write(out); werr != nil {
+					return werr
+				}
+			}
+			if transforms.stopped {
+				// Close the stream ourselves, the rest of the upstream body is discarded
+				closing, ferr := transforms.finish()
+				if ferr != nil {
+					s.log.Errorf("Failed to finish stopped stream: %v", ferr)
+				}
+				_, werr := c.Writer.Write(append([]byte("\n"), closing...))
+				flush()
+				return werr
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				flush()
+			}
+		}
+		if err != nil {
+			// The stream is closed for the client both on a clean end and on a broken upstream,
+			// the read error of the latter is still returned to be logged
+			if s.cfg.SynthesizeDone && !transforms.sawDone {
+				if errors.Is(err, io.EOF) {
+					s.log.Warnf("Upstream stream ended without [DONE], synthesized one")
+				} else {
+					s.log.Warnf("Upstream stream broke off without [DONE], synthesized one: %v", err)
+				}
+				closing, ferr := transforms.finish()
+				if ferr != nil {
+					s.log.Errorf("Failed to finish stream: %v", ferr)
+				}
+				if _, werr := c.Writer.Write(append([]byte("\n"), closing...)); werr != nil {
+					return werr
+				}
+			}
+			c.Writer.Flush()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
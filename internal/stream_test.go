@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFirstByteTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr error
+		want    string
+	}{
+		{
+			name: "headers arrive late",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+				}
+			},
+			wantErr: ErrorFirstByteTimeout,
+		},
+		{
+			name: "body arrives late",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+				}
+			},
+			wantErr: ErrorFirstByteTimeout,
+		},
+		{
+			name: "slow body after the first byte",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("a"))
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("b"))
+			},
+			want: "ab",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req, fbt := withFirstByteTimeout(req, 50*time.Millisecond)
+			resp, err := http.DefaultClient.Do(req)
+			var body []byte
+			if err == nil {
+				resp.Body = fbt.wrap(resp.Body)
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			} else {
+				err = fbt.err(err)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireStreamSlot(t *testing.T) {
+	const streamBody = `{"stream":true}`
+
+	tests := []struct {
+		name      string
+		slots     int
+		busy      int
+		queueSize int
+		body      string
+		cancel    bool
+		wantErr   error
+	}{
+		{name: "unlimited", body: streamBody},
+		{name: "buffered request skips the limit", slots: 1, busy: 1, body: `{"stream":false}`},
+		{name: "free slot", slots: 2, busy: 1, body: streamBody},
+		{name: "no queue", slots: 1, busy: 1, body: streamBody, wantErr: ErrorStreamSlotsBusy},
+		{name: "queue timeout", slots: 1, busy: 1, queueSize: 1, body: streamBody, wantErr: ErrorStreamSlotsBusy},
+		{name: "client gone while queued", slots: 1, busy: 1, queueSize: 1, body: streamBody, cancel: true, wantErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{ConcurrencyQueueSize: tt.queueSize, ConcurrencyQueueTimeoutMs: 20})
+			if tt.slots > 0 {
+				s.streamSlots = make(chan struct{}, tt.slots)
+				for i := 0; i < tt.busy; i++ {
+					s.streamSlots <- struct{}{}
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			release, err := s.acquireStreamSlot(ctx, []byte(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquireStreamSlot() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				release()
+			}
+			if tt.slots > 0 && len(s.streamSlots) != tt.busy {
+				t.Errorf("busy slots = %d, want %d", len(s.streamSlots), tt.busy)
+			}
+			if queued := s.streamQueued.Load(); queued != 0 {
+				t.Errorf("queued = %d, want 0", queued)
+			}
+		})
+	}
+}
+
+func TestFirstByteTimeoutResponds504(t *testing.T) {
+	t.Parallel()
+	tp := newTestProxy(t, &ServiceConfig{FirstByteTimeoutMs: 100}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"x"}`, nil)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusGatewayTimeout, w.Body.String())
+	}
+	// A first byte timeout fails fast instead of being retried
+	if got := tp.upstreamCalls(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
+
+func TestFirstByteTimerStoppedForHeldResponse(t *testing.T) {
+	t.Parallel()
+	const body = `{"error":"slow down"}`
+	tp := newTestProxy(t, &ServiceConfig{FirstByteTimeoutMs: 100}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, body)
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, tp.upstream.URL, nil)
+	resp, err := tp.executeHTTPRequestWithRetry(req, RequestTypeCodex)
+	if err != nil {
+		t.Fatalf("executeHTTPRequestWithRetry() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The held 429 is read after the first byte budget has passed
+	time.Sleep(200 * time.Millisecond)
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the held response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || string(got) != body {
+		t.Errorf("response = %d %s, want %d %s", resp.StatusCode, got, http.StatusTooManyRequests, body)
+	}
+}
+
+func TestStreamFirstByteMetric(t *testing.T) {
+	t.Parallel()
+	delay := 150 * time.Millisecond
+	tp := newTestProxy(t, &ServiceConfig{DisableModelMapping: true}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, content := range []string{"a", "b"} {
+			time.Sleep(delay)
+			io.WriteString(w, `data: {"choices":[{"delta":{"content":"`+content+`"}}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	})
+	// The metrics are registered once per process, drop the samples of earlier runs
+	tp.metrics.streamFirstByte.DeleteLabelValues("ttfb-test-model")
+	tp.metrics.streamChunkGap.DeleteLabelValues("ttfb-test-model")
+
+	w := tp.do(http.MethodPost, "/v1/chat/completions", `{"model":"ttfb-test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	firstByte := histogramOf(t, tp.metrics.streamFirstByte, "ttfb-test-model")
+	if firstByte.GetSampleCount() != 1 {
+		t.Fatalf("first byte samples = %d, want 1", firstByte.GetSampleCount())
+	}
+	if got := time.Duration(firstByte.GetSampleSum() * float64(time.Second)); got < delay {
+		t.Errorf("first byte time = %v, want at least %v", got, delay)
+	}
+	// The second event arrives about a delay after the first one, the proxy measures the gap
+	// between its own flushes, which can come out slightly shorter
+	gaps := histogramOf(t, tp.metrics.streamChunkGap, "ttfb-test-model")
+	if gaps.GetSampleCount() == 0 {
+		t.Fatal("no chunk gap recorded")
+	}
+	if got := time.Duration(gaps.GetSampleSum() * float64(time.Second)); got < delay/2 {
+		t.Errorf("chunk gaps = %v, want at least %v", got, delay/2)
+	}
+}
+
+// histogramOf returns the histogram of vec for model.
+func histogramOf(t *testing.T, vec *prometheus.HistogramVec, model string) *dto.Histogram {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues(model).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	return m.GetHistogram()
+}
+
+func TestValidateStreamChunks(t *testing.T) {
+	t.Parallel()
+	upstream := respondEvents([]string{
+		`{"choices":[{"index":0,"text":"a"}]}`,
+		`{"choices":[{"index":0,"text":`,
+		`{"choices":[{"index":0,"text":"b"}]}`,
+	}, false)
+	tests := []struct {
+		name        string
+		validate    bool
+		wantInvalid bool
+	}{
+		{name: "forwarded verbatim", wantInvalid: true},
+		{name: "invalid frame dropped", validate: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ValidateChunks: tt.validate}, upstream)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p","stream":true}`, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			if got := strings.Contains(body, `"text":`+"\n"); got != tt.wantInvalid {
+				t.Errorf("invalid frame forwarded = %v, want %v: %q", got, tt.wantInvalid, body)
+			}
+			for _, want := range []string{`"text":"a"`, `"text":"b"`, "data: [DONE]"} {
+				if !strings.Contains(body, want) {
+					t.Errorf("body = %q, want %s", body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	t.Parallel()
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	tp := newTestProxy(t, &ServiceConfig{MaxConcurrentStreams: 1}, func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); !strings.Contains(string(body), `"stream":true`) {
+			respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`)(w, r)
+			return
+		}
+		streaming <- struct{}{}
+		<-release
+		respondEvents([]string{`{"choices":[{"text":"a"}]}`}, false)(w, r)
+	})
+	const path = "/v1/engines/copilot-codex/completions"
+
+	first := make(chan int)
+	go func() {
+		first <- tp.do(http.MethodPost, path, `{"prompt":"p","stream":true}`, nil).Code
+	}()
+	<-streaming
+
+	// The only stream slot is taken, buffered requests are not affected
+	if w := tp.do(http.MethodPost, path, `{"prompt":"p","stream":true}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("second stream status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w := tp.do(http.MethodPost, path, `{"prompt":"p"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("buffered status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first stream status = %d, want %d", code, http.StatusOK)
+	}
+	go func() { <-streaming }()
+	if w := tp.do(http.MethodPost, path, `{"prompt":"p","stream":true}`, nil); w.Code != http.StatusOK {
+		t.Errorf("stream after release status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestStreamMaxChars(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		frame    string
+		maxChars int
+		want     []string
+		wantNot  []string
+	}{
+		{
+			name:  "unlimited",
+			path:  "/v1/engines/copilot-codex/completions",
+			body:  `{"prompt":"p","stream":true}`,
+			frame: `{"choices":[{"index":0,"text":"%s"}]}`,
+			want:  []string{`"text":"abc"`, `"text":"def"`, `"text":"ghi"`},
+		},
+		{
+			name:     "codex stream cut",
+			path:     "/v1/engines/copilot-codex/completions",
+			body:     `{"prompt":"p","stream":true}`,
+			frame:    `{"choices":[{"index":0,"text":"%s"}]}`,
+			maxChars: 4,
+			want:     []string{`"text":"abc"`, `"text":"d"`, `"finish_reason":"length"`},
+			wantNot:  []string{"def", "ghi"},
+		},
+		{
+			name:     "chat stream cut",
+			path:     "/v1/chat/completions",
+			body:     `{"messages":[{"role":"user","content":"hi"}],"stream":true}`,
+			frame:    `{"choices":[{"index":0,"delta":{"content":"%s"}}]}`,
+			maxChars: 3,
+			want:     []string{`"content":"abc"`, `"finish_reason":"length"`},
+			wantNot:  []string{"def", "ghi"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var frames []string
+			for _, text := range []string{"abc", "def", "ghi"} {
+				frames = append(frames, fmt.Sprintf(tt.frame, text))
+			}
+			cfg := &ServiceConfig{StreamMaxChars: tt.maxChars, DisableLocale: true}
+			tp := newTestProxy(t, cfg, respondEvents(frames, false))
+
+			w := tp.do(http.MethodPost, tt.path, tt.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			for _, want := range append(tt.want, "data: [DONE]") {
+				if !strings.Contains(body, want) {
+					t.Errorf("body = %q, want %s", body, want)
+				}
+			}
+			for _, unwanted := range tt.wantNot {
+				if strings.Contains(body, unwanted) {
+					t.Errorf("body = %q, want no %s", body, unwanted)
+				}
+			}
+			if n := strings.Count(body, "data: [DONE]"); n != 1 {
+				t.Errorf("[DONE] frames = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSynthesizeDone(t *testing.T) {
+	t.Parallel()
+	frames := []string{`{"choices":[{"index":0,"text":"a"}]}`}
+	// brokenStream sends one frame and drops the connection in the middle of the next one
+	brokenStream := func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n")
+		for _, chunk := range []string{"data: " + frames[0] + "\n\n", `data: {"choi`} {
+			buf.WriteString(fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk))
+		}
+		buf.Flush()
+	}
+	tests := []struct {
+		name       string
+		synthesize bool
+		handler    http.HandlerFunc
+		wantDone   int
+	}{
+		{name: "complete stream", synthesize: true, handler: respondEvents(frames, false), wantDone: 1},
+		{name: "truncated stream forwarded as is", handler: respondEvents(frames, true)},
+		{name: "truncated stream closed", synthesize: true, handler: respondEvents(frames, true), wantDone: 1},
+		{name: "broken stream closed", synthesize: true, handler: brokenStream, wantDone: 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{SynthesizeDone: tt.synthesize}, tt.handler)
+
+			w := tp.do(http.MethodPost, "/v1/engines/copilot-codex/completions", `{"prompt":"p","stream":true}`, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, `"text":"a"`) {
+				t.Errorf("body = %q, want the upstream frame", body)
+			}
+			if strings.Contains(body, `{"choi`+"\n") {
+				t.Errorf("body = %q, want the cut off frame dropped", body)
+			}
+			if got := strings.Count(body, "data: [DONE]"); got != tt.wantDone {
+				t.Errorf("[DONE] frames = %d, want %d: %q", got, tt.wantDone, body)
+			}
+		})
+	}
+}
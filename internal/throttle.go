@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxThrottledMessages bounds the number of distinct messages tracked by errorThrottle.
+const maxThrottledMessages = 1024
+
+// errorThrottle deduplicates identical error messages logged within a window. The first
+// occurrence is logged, repeats are counted and reported with the next logged occurrence,
+// or by the periodic flush once the window has passed without one.
+type errorThrottle struct {
+	log      *zap.SugaredLogger
+	window   time.Duration
+	mu       sync.Mutex
+	entries  map[string]*throttledMessage
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+type throttledMessage struct {
+	loggedAt   time.Time
+	suppressed int
+}
+
+func newErrorThrottle(logger *zap.SugaredLogger, window time.Duration) *errorThrottle {
+	// Skip this wrapper so log lines point at the caller
+	return &errorThrottle{log: logger.WithOptions(zap.AddCallerSkip(1)), window: window, entries: make(map[string]*throttledMessage), stopCh: make(chan struct{})}
+}
+
+// start flushes the messages whose window has passed once every window, so the repeats of a
+// burst that stopped are still reported.
+func (et *errorThrottle) start() {
+	if et.window <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(et.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				et.flush(now, false)
+			case <-et.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends the periodic flush and reports every pending repeat count.
+func (et *errorThrottle) stop() {
+	et.stopOnce.Do(func() {
+		close(et.stopCh)
+		et.flush(time.Now(), true)
+	})
+}
+
+// flush reports the repeat counts of the messages whose window has passed, or of all
+// messages, and forgets them.
+func (et *errorThrottle) flush(now time.Time, all bool) {
+	et.mu.Lock()
+	var reports []string
+	for msg, entry := range et.entries {
+		if !all && now.Sub(entry.loggedAt) < et.window {
+			continue
+		}
+		if entry.suppressed > 0 {
+			reports = append(reports, fmt.Sprintf("%s (repeated %d times in last %s)", msg, entry.suppressed, et.window))
+		}
+		delete(et.entries, msg)
+	}
+	et.mu.Unlock()
+
+	for _, report := range reports {
+		et.log.Error(report)
+	}
+}
+
+func (et *errorThrottle) Errorf(template string, args ...interface{}) {
+	if et.window <= 0 {
+		et.log.Errorf(template, args...)
+		return
+	}
+
+	msg := fmt.Sprintf(template, args...)
+	now := time.Now()
+
+	et.mu.Lock()
+	entry, ok := et.entries[msg]
+	if ok && now.Sub(entry.loggedAt) < et.window {
+		entry.suppressed++
+		et.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	if !ok && len(et.entries) >= maxThrottledMessages {
+		et.prune(now)
+	}
+	et.entries[msg] = &throttledMessage{loggedAt: now}
+	et.mu.Unlock()
+
+	if suppressed > 0 {
+		et.log.Errorf("%s (repeated %d times in last %s)", msg, suppressed, et.window)
+		return
+	}
+	et.log.Error(msg)
+}
+
+// prune drops the messages whose window has passed, or all of them if none has.
+func (et *errorThrottle) prune(now time.Time) {
+	for msg, entry := range et.entries {
+		if now.Sub(entry.loggedAt) >= et.window {
+			delete(et.entries, msg)
+		}
+	}
+	if len(et.entries) >= maxThrottledMessages {
+		et.entries = make(map[string]*throttledMessage)
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorThrottle(t *testing.T) {
+	const window = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		repeats int
+		flush   func(et *errorThrottle)
+		want    []string
+	}{
+		{
+			name:    "single message",
+			repeats: 1,
+			flush:   func(et *errorThrottle) { et.stop() },
+			want:    []string{"upstream down"},
+		},
+		{
+			name:    "burst reported on stop",
+			repeats: 4,
+			flush:   func(et *errorThrottle) { et.stop() },
+			want:    []string{"upstream down", "upstream down (repeated 3 times in last 50ms)"},
+		},
+		{
+			name:    "burst reported after the window",
+			repeats: 3,
+			flush:   func(et *errorThrottle) { et.flush(time.Now().Add(window), false) },
+			want:    []string{"upstream down", "upstream down (repeated 2 times in last 50ms)"},
+		},
+		{
+			name:    "burst kept within the window",
+			repeats: 3,
+			flush:   func(et *errorThrottle) { et.flush(time.Now(), false) },
+			want:    []string{"upstream down"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.ErrorLevel)
+			et := newErrorThrottle(zap.New(core).Sugar(), window)
+			for i := 0; i < tt.repeats; i++ {
+				et.Errorf("upstream %s", "down")
+			}
+			tt.flush(et)
+
+			var got []string
+			for _, entry := range logs.All() {
+				got = append(got, entry.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorThrottleTicker(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	et := newErrorThrottle(zap.New(core).Sugar(), 20*time.Millisecond)
+	et.start()
+	defer et.stop()
+
+	et.Errorf("upstream down")
+	et.Errorf("upstream down")
+
+	deadline := time.Now().Add(time.Second)
+	for logs.Len() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if logs.Len() != 2 || !strings.Contains(logs.All()[1].Message, "repeated 1 times") {
+		t.Errorf("ticker did not report the suppressed repeat: %v", logs.All())
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const HeaderLdorTiming = "X-Ldor-Timing"
+
+// requestTiming records how long each phase of a request took. Phases are measured as laps,
+// each one from the end of the previous phase. A nil requestTiming records nothing, so the
+// handlers need not check whether timing is enabled.
+type requestTiming struct {
+	start  time.Time
+	last   time.Time
+	phases []timingPhase
+}
+
+type timingPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// startTiming attaches a requestTiming to the request, it is registered when ExposeTiming is set.
+func startTiming(c *gin.Context) {
+	now := time.Now()
+	c.Set(ContextKeyTiming, &requestTiming{start: now, last: now})
+}
+
+func timingFrom(c *gin.Context) *requestTiming {
+	rt, _ := c.Value(ContextKeyTiming).(*requestTiming)
+	return rt
+}
+
+// lap ends the named phase now.
+func (rt *requestTiming) lap(name string) {
+	if rt == nil {
+		return
+	}
+	now := time.Now()
+	rt.phases = append(rt.phases, timingPhase{name: name, duration: now.Sub(rt.last)})
+	rt.last = now
+}
+
+// add records a phase measured by the caller, it does not move the lap mark.
+func (rt *requestTiming) add(name string, duration time.Duration) {
+	if rt == nil {
+		return
+	}
+	rt.phases = append(rt.phases, timingPhase{name: name, duration: duration})
+}
+
+// header formats the phases and the total so far in the Server-Timing syntax, durations in
+// milliseconds, e.g. "read;dur=0.12, transform;dur=0.40, total;dur=130.51".
+func (rt *requestTiming) header() string {
+	parts := make([]string, 0, len(rt.phases)+1)
+	for _, phase := range rt.phases {
+		parts = append(parts, formatTimingPhase(phase.name, phase.duration))
+	}
+	parts = append(parts, formatTimingPhase("total", time.Since(rt.start)))
+	return strings.Join(parts, ", ")
+}
+
+func formatTimingPhase(name string, duration time.Duration) string {
+	return name + ";dur=" + strconv.FormatFloat(float64(duration.Microseconds())/1000, 'f', 2, 64)
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimingHeader(t *testing.T) {
+	// A nil timing records nothing
+	var disabled *requestTiming
+	disabled.lap("read")
+	disabled.add("ttfb", time.Second)
+
+	rt := &requestTiming{start: time.Now(), last: time.Now()}
+	rt.lap("read")
+	rt.add("ttfb", 1500*time.Microsecond)
+
+	header := rt.header()
+	if !regexp.MustCompile(`^read;dur=\d+\.\d{2}, ttfb;dur=1\.50, total;dur=\d+\.\d{2}$`).MatchString(header) {
+		t.Errorf("header = %q, want the read, ttfb and total phases", header)
+	}
+}
+
+func TestExposeTiming(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		expose     bool
+		path       string
+		body       string
+		wantPhases []string
+	}{
+		{name: "disabled", path: "/v1/engines/copilot-codex/completions", body: `{"prompt":"p"}`},
+		{
+			name:       "code completion",
+			expose:     true,
+			path:       "/v1/engines/copilot-codex/completions",
+			body:       `{"prompt":"p"}`,
+			wantPhases: []string{"ratelimit", "read", "transform", "queue", "ttfb", "total"},
+		},
+		{
+			name:       "chat completion",
+			expose:     true,
+			path:       "/v1/chat/completions",
+			body:       `{"messages":[{"role":"user","content":"hi"}]}`,
+			wantPhases: []string{"ratelimit", "read", "transform", "queue", "ttfb", "total"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tp := newTestProxy(t, &ServiceConfig{ExposeTiming: tt.expose}, respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`))
+
+			w := tp.do(http.MethodPost, tt.path, tt.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			header := w.Header().Get(HeaderLdorTiming)
+			var phases []string
+			for _, part := range strings.Split(header, ", ") {
+				if name, _, ok := strings.Cut(part, ";dur="); ok {
+					phases = append(phases, name)
+				}
+			}
+			if strings.Join(phases, ",") != strings.Join(tt.wantPhases, ",") {
+				t.Errorf("%s = %q, want phases %q", HeaderLdorTiming, header, tt.wantPhases)
+			}
+		})
+	}
+}
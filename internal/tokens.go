@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// charsPerToken approximates the tokenizer, ldor does not ship one. English text averages
+// about four characters per token, so the estimate errs on the high side for most prompts.
+const charsPerToken = 4
+
+// estimatePromptTokens approximates the number of prompt tokens of a chat request body from
+// the text of its messages.
+func estimatePromptTokens(body []byte) int {
+	chars := 0
+	for _, msg := range gjson.GetBytes(body, "messages").Array() {
+		content := msg.Get("content")
+		if content.IsArray() {
+			for _, part := range content.Array() {
+				chars += utf8.RuneCountInString(part.Get("text").String())
+			}
+			continue
+		}
+		chars += utf8.RuneCountInString(content.String())
+	}
+	return (chars + charsPerToken - 1) / charsPerToken
+}
+
+// fitMaxTokens clamps max_tokens to maxAllowed. With AutoFitMaxTokens it is also clamped, or
+// set when absent, to the context budget left after the prompt and AutoFitSafetyMargin. Only
+// models with a ModelContextLimits entry are fitted, the prompt token caps reported by the
+// upstream are not context windows. A prompt over the limit still gets a max_tokens of 1, the
+// upstream then reports the overflow.
+func (s *ProxyService) fitMaxTokens(body []byte, maxAllowed int) ([]byte, error) {
+	if !s.cfg.AutoFitMaxTokens {
+		return s.setMaxTokensIfExceeded(body, "max_tokens", maxAllowed)
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	limit, ok := s.cfg.ModelContextLimits[model]
+	if !ok {
+		return s.setMaxTokensIfExceeded(body, "max_tokens", maxAllowed)
+	}
+
+	promptTokens := estimatePromptTokens(body)
+	remaining := limit - promptTokens - s.cfg.AutoFitSafetyMargin
+	if remaining < 1 {
+		s.log.Warnf("Prompt of about %d tokens leaves no room in the %d token context of %s", promptTokens, limit, model)
+		remaining = 1
+	}
+	fitted := min(maxAllowed, remaining)
+	if maxTokens := gjson.GetBytes(body, "max_tokens"); maxTokens.Exists() && int(maxTokens.Int()) <= fitted {
+		return body, nil
+	}
+	return s.setJSONField(body, "max_tokens", fitted)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestEstimatePromptTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "no messages", body: `{}`, want: 0},
+		{name: "string content", body: `{"messages":[{"role":"user","content":"12345678"}]}`, want: 2},
+		{name: "rounds up", body: `{"messages":[{"role":"user","content":"123456789"}]}`, want: 3},
+		{name: "content parts", body: `{"messages":[{"role":"user","content":[{"type":"text","text":"1234"},{"type":"text","text":"5678"}]}]}`, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimatePromptTokens([]byte(tt.body)); got != tt.want {
+				t.Errorf("estimatePromptTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitMaxTokens(t *testing.T) {
+	// 40 characters, about 10 prompt tokens
+	const prompt = `"messages":[{"role":"user","content":"0123456789012345678901234567890123456789"}]`
+
+	tests := []struct {
+		name string
+		cfg  *ServiceConfig
+		body string
+		want int64
+	}{
+		{
+			name: "clamped to the configured maximum without auto fit",
+			cfg:  &ServiceConfig{ModelContextLimits: map[string]int{"m": 50}},
+			body: `{"model":"m","max_tokens":500,` + prompt + `}`,
+			want: 100,
+		},
+		{
+			name: "fitted to the remaining context",
+			cfg:  &ServiceConfig{AutoFitMaxTokens: true, AutoFitSafetyMargin: 5, ModelContextLimits: map[string]int{"m": 50}},
+			body: `{"model":"m","max_tokens":500,` + prompt + `}`,
+			want: 35,
+		},
+		{
+			name: "set when absent",
+			cfg:  &ServiceConfig{AutoFitMaxTokens: true, ModelContextLimits: map[string]int{"m": 50}},
+			body: `{"model":"m",` + prompt + `}`,
+			want: 40,
+		},
+		{
+			name: "smaller max_tokens is kept",
+			cfg:  &ServiceConfig{AutoFitMaxTokens: true, ModelContextLimits: map[string]int{"m": 50}},
+			body: `{"model":"m","max_tokens":8,` + prompt + `}`,
+			want: 8,
+		},
+		{
+			name: "overflowing prompt gets one token",
+			cfg:  &ServiceConfig{AutoFitMaxTokens: true, ModelContextLimits: map[string]int{"m": 5}},
+			body: `{"model":"m","max_tokens":8,` + prompt + `}`,
+			want: 1,
+		},
+		{
+			name: "model without a context limit is only clamped",
+			cfg:  &ServiceConfig{AutoFitMaxTokens: true, ModelContextLimits: map[string]int{"other": 5}},
+			body: `{"model":"m","max_tokens":500,` + prompt + `}`,
+			want: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newTestService(t, tt.cfg).fitMaxTokens([]byte(tt.body), 100)
+			if err != nil {
+				t.Fatalf("fitMaxTokens() error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "max_tokens").Int(); got != tt.want {
+				t.Errorf("max_tokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
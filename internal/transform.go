@@ -0,0 +1,501 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var ErrorLogitBiasTooLarge = errors.New("logit_bias has too many entries")
+
+// stopSequences returns the `stop` field of body as a list, it may be a string or an array.
+func stopSequences(body []byte) []string {
+	stop := gjson.GetBytes(body, "stop")
+	if stop.Type == gjson.String {
+		return []string{stop.Str}
+	}
+	if !stop.IsArray() {
+		return nil
+	}
+	items := stop.Array()
+	stops := make([]string, 0, len(items))
+	for _, item := range items {
+		stops = append(stops, item.String())
+	}
+	return stops
+}
+
+// mergeStopSequences joins the stop lists in order and drops duplicates and empty values.
+func mergeStopSequences(lists ...[]string) []string {
+	seen := make(map[string]struct{})
+	merged := make([]string, 0)
+	for _, list := range lists {
+		for _, stop := range list {
+			if _, ok := seen[stop]; ok || stop == "" {
+				continue
+			}
+			seen[stop] = struct{}{}
+			merged = append(merged, stop)
+		}
+	}
+	return merged
+}
+
+// applyStopSequences merges the stop sequences of the client, those of the resolved model and
+// the default ones into body and clamps the result to MaxStopSequences. Client sequences come
+// first, so they are the last to be dropped by the clamp.
+func (s *ProxyService) applyStopSequences(body []byte) ([]byte, error) {
+	clientStops := stopSequences(body)
+	modelStops := s.cfg.ModelStopSequences[gjson.GetBytes(body, "model").String()]
+	if len(s.cfg.DefaultStopSequences) == 0 && len(modelStops) == 0 && (s.cfg.MaxStopSequences <= 0 || len(clientStops) <= s.cfg.MaxStopSequences) {
+		return body, nil
+	}
+
+	stops := mergeStopSequences(clientStops, modelStops, s.cfg.DefaultStopSequences)
+	if s.cfg.MaxStopSequences > 0 && len(stops) > s.cfg.MaxStopSequences {
+		s.log.Warnf("Too many stop sequences (%d), truncated to %d", len(stops), s.cfg.MaxStopSequences)
+		stops = stops[:s.cfg.MaxStopSequences]
+	}
+	return s.setJSONField(body, "stop", stops)
+}
+
+// splitChoicePath splits a path such as "choices.#.text" into the array path and the
+// path of the value inside each element. Paths without "#" address a single value.
+func splitChoicePath(path string) (string, string, bool) {
+	arrayPath, itemPath, ok := strings.Cut(path, ".#.")
+	return arrayPath, itemPath, ok
+}
+
+// completionTextPath returns the configured location of the completion text for a request type.
+func (s *ProxyService) completionTextPath(requestType string) string {
+	if requestType == RequestTypeChat {
+		return s.cfg.ChatContentPath
+	}
+	return s.cfg.CodexTextPath
+}
+
+// completionTexts returns every completion text found at path in a response body.
+func completionTexts(body []byte, path string) []string {
+	arrayPath, itemPath, ok := splitChoicePath(path)
+	if !ok {
+		if value := gjson.GetBytes(body, path); value.Exists() {
+			return []string{value.String()}
+		}
+		return nil
+	}
+
+	texts := make([]string, 0)
+	for _, item := range gjson.GetBytes(body, arrayPath).Array() {
+		if value := item.Get(itemPath); value.Exists() {
+			texts = append(texts, value.String())
+		}
+	}
+	return texts
+}
+
+// rewriteCompletionTexts replaces every completion text found at path with the result of fn.
+func rewriteCompletionTexts(body []byte, path string, fn func(string) string) ([]byte, error) {
+	arrayPath, itemPath, ok := splitChoicePath(path)
+	if !ok {
+		value := gjson.GetBytes(body, path)
+		if !value.Exists() {
+			return body, nil
+		}
+		return sjson.SetBytes(body, path, fn(value.String()))
+	}
+
+	var err error
+	for i, item := range gjson.GetBytes(body, arrayPath).Array() {
+		value := item.Get(itemPath)
+		if !value.Exists() {
+			continue
+		}
+		if body, err = sjson.SetBytes(body, arrayPath+"."+strconv.Itoa(i)+"."+itemPath, fn(value.String())); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// reconcileAcceptStream enables streaming in body when the client accepts server-sent events
+// but did not ask for a stream explicitly. Clients listed in NonStreamAgents are left alone.
+func (s *ProxyService) reconcileAcceptStream(body []byte, header http.Header) ([]byte, error) {
+	if !s.cfg.RespectAcceptStream || !strings.Contains(header.Get("Accept"), "text/event-stream") {
+		return body, nil
+	}
+	if s.isNonStreamAgent(header.Get("User-Agent")) {
+		return body, nil
+	}
+	if gjson.GetBytes(body, "stream").Bool() {
+		return body, nil
+	}
+	return s.setJSONField(body, "stream", true)
+}
+
+// isNonStreamAgent reports whether userAgent contains one of the NonStreamAgents.
+func (s *ProxyService) isNonStreamAgent(userAgent string) bool {
+	for _, agent := range s.cfg.NonStreamAgents {
+		if agent != "" && strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// forceNonStream sets `stream` to false for clients listed in NonStreamAgents, which ask for
+// a stream but cannot parse server-sent events. The upstream then answers with one buffered
+// body. `stream_options` is only valid with a stream and is dropped as well.
+func (s *ProxyService) forceNonStream(body []byte, header http.Header) ([]byte, error) {
+	if !gjson.GetBytes(body, "stream").Bool() || !s.isNonStreamAgent(header.Get("User-Agent")) {
+		return body, nil
+	}
+	body, err := s.setJSONField(body, "stream", false)
+	if err != nil {
+		return nil, err
+	}
+	return s.deleteFields(body, []string{"stream_options"})
+}
+
+// mergeConsecutiveRoles joins adjacent messages of the same role into one message. Messages
+// without plain text content and tool results are left untouched.
+func (s *ProxyService) mergeConsecutiveRoles(body []byte) ([]byte, error) {
+	if !s.cfg.MergeConsecutiveRoles {
+		return body, nil
+	}
+
+	messages := gjson.GetBytes(body, "messages").Array()
+	if len(messages) < 2 {
+		return body, nil
+	}
+
+	raws := make([]string, 0, len(messages))
+	prevRole, prevMergeable := "", false
+	for _, msg := range messages {
+		role := msg.Get("role").String()
+		content := msg.Get("content")
+		mergeable := content.Type == gjson.String && role != "tool" && !msg.Get("tool_calls").Exists()
+
+		if mergeable && prevMergeable && role == prevRole {
+			last := len(raws) - 1
+			merged, err := sjson.Set(raws[last], "content", gjson.Get(raws[last], "content").String()+"\n\n"+content.String())
+			if err != nil {
+				return nil, s.logError("merging messages", err)
+			}
+			raws[last] = merged
+			continue
+		}
+
+		raws = append(raws, msg.Raw)
+		prevRole, prevMergeable = role, mergeable
+	}
+
+	if len(raws) == len(messages) {
+		return body, nil
+	}
+
+	newBody, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(raws, ",")+"]"))
+	if err != nil {
+		return nil, s.logError("setting messages", err)
+	}
+	return newBody, nil
+}
+
+// downgradeSystemRole rewrites the system messages for the models listed in SystemRoleModels.
+// The convert mode turns them into user messages, the merge mode prepends their text to the
+// first user message and falls back to converting when there is none to merge into.
+func (s *ProxyService) downgradeSystemRole(body []byte) ([]byte, error) {
+	if !s.cfg.DowngradeSystemRole {
+		return body, nil
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	listed := false
+	for _, m := range s.cfg.SystemRoleModels {
+		if m == model {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		return body, nil
+	}
+
+	messages := gjson.GetBytes(body, "messages").Array()
+	firstUser := -1
+	var systemTexts []string
+	for i, msg := range messages {
+		role := msg.Get("role").String()
+		if firstUser < 0 && role == "user" && msg.Get("content").Type == gjson.String {
+			firstUser = i
+		}
+		if role == "system" && msg.Get("content").Type == gjson.String {
+			systemTexts = append(systemTexts, msg.Get("content").String())
+		}
+	}
+	merge := s.cfg.SystemRoleMode == SystemRoleMerge && firstUser >= 0
+
+	raws := make([]string, 0, len(messages))
+	changed := false
+	for i, msg := range messages {
+		raw := msg.Raw
+		var err error
+		switch {
+		case msg.Get("role").String() == "system":
+			changed = true
+			if merge && msg.Get("content").Type == gjson.String {
+				continue
+			}
+			raw, err = sjson.Set(raw, "role", "user")
+		case merge && i == firstUser && len(systemTexts) > 0:
+			raw, err = sjson.Set(raw, "content", strings.Join(systemTexts, "\n\n")+"\n\n"+msg.Get("content").String())
+		}
+		if err != nil {
+			return nil, s.logError("downgrading system message", err)
+		}
+		raws = append(raws, raw)
+	}
+
+	if !changed {
+		return body, nil
+	}
+
+	newBody, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(raws, ",")+"]"))
+	if err != nil {
+		return nil, s.logError("setting messages", err)
+	}
+	return newBody, nil
+}
+
+// limitLogprobs strips `logprobs` for the models listed in NoLogprobsModels and clamps it to
+// CodexMaxLogprobs for the others.
+func (s *ProxyService) limitLogprobs(body []byte) ([]byte, error) {
+	logprobs := gjson.GetBytes(body, "logprobs")
+	if !logprobs.Exists() {
+		return body, nil
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	for _, m := range s.cfg.NoLogprobsModels {
+		if m == model {
+			return s.deleteFields(body, []string{"logprobs"})
+		}
+	}
+
+	if s.cfg.CodexMaxLogprobs > 0 && logprobs.Int() > int64(s.cfg.CodexMaxLogprobs) {
+		return s.setJSONField(body, "logprobs", s.cfg.CodexMaxLogprobs)
+	}
+	return body, nil
+}
+
+// normalizePromptText strips a leading byte order mark and converts CRLF line endings to LF.
+func normalizePromptText(text string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(text, "\uFEFF"), "\r\n", "\n")
+}
+
+// normalizePrompt applies normalizePromptText to the prompt and suffix of a completion request
+// and to the text of every chat message, including text parts, when NormalizePrompt is set.
+func (s *ProxyService) normalizePrompt(body []byte) ([]byte, error) {
+	if !s.cfg.NormalizePrompt {
+		return body, nil
+	}
+
+	paths := []string{"prompt", "suffix"}
+	for i, msg := range gjson.GetBytes(body, "messages").Array() {
+		content := msg.Get("content")
+		if content.Type == gjson.String {
+			paths = append(paths, fmt.Sprintf("messages.%d.content", i))
+			continue
+		}
+		for j := range content.Array() {
+			paths = append(paths, fmt.Sprintf("messages.%d.content.%d.text", i, j))
+		}
+	}
+
+	var err error
+	for _, path := range paths {
+		value := gjson.GetBytes(body, path)
+		if value.Type != gjson.String {
+			continue
+		}
+		if normalized := normalizePromptText(value.Str); normalized != value.Str {
+			if body, err = s.setJSONField(body, path, normalized); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return body, nil
+}
+
+// applyPenaltyMode clamps the penalties to the OpenAI range or strips them, as configured.
+func (s *ProxyService) applyPenaltyMode(body []byte) ([]byte, error) {
+	var err error
+	for _, key := range []string{"frequency_penalty", "presence_penalty"} {
+		value := gjson.GetBytes(body, key)
+		if !value.Exists() {
+			continue
+		}
+
+		switch s.cfg.PenaltyMode {
+		case PenaltyModeStrip:
+			if body, err = s.deleteFields(body, []string{key}); err != nil {
+				return nil, err
+			}
+		case PenaltyModeClamp:
+			if clamped := math.Max(-2, math.Min(2, value.Float())); clamped != value.Float() || value.Type != gjson.Number {
+				if body, err = s.setJSONField(body, key, clamped); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return body, nil
+}
+
+// applyHeaderToBody sets the JSON paths configured in HeaderToBody from the matching request
+// headers. Absent headers are skipped.
+func (s *ProxyService) applyHeaderToBody(body []byte, header http.Header) ([]byte, error) {
+	if len(s.cfg.HeaderToBody) == 0 {
+		return body, nil
+	}
+
+	names := make([]string, 0, len(s.cfg.HeaderToBody))
+	for name := range s.cfg.HeaderToBody {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var err error
+	for _, name := range names {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if body, err = sjson.SetBytes(body, s.cfg.HeaderToBody[name], value); err != nil {
+			return nil, s.logError("setting "+s.cfg.HeaderToBody[name]+" from header "+name, err)
+		}
+	}
+	return body, nil
+}
+
+// limitLogitBias enforces MaxLogitBiasEntries, either keeping the first entries of an
+// oversized logit_bias or rejecting the request with ErrorLogitBiasTooLarge.
+func (s *ProxyService) limitLogitBias(body []byte) ([]byte, error) {
+	limit := s.cfg.MaxLogitBiasEntries
+	bias := gjson.GetBytes(body, "logit_bias")
+	if limit <= 0 || !bias.IsObject() {
+		return body, nil
+	}
+
+	entries := make([]string, 0, limit)
+	count := 0
+	bias.ForEach(func(key, value gjson.Result) bool {
+		count++
+		if len(entries) < limit {
+			entries = append(entries, key.Raw+":"+value.Raw)
+		}
+		return true
+	})
+	if count <= limit {
+		return body, nil
+	}
+
+	if s.cfg.LogitBiasOverflowMode == MessageOverflowReject {
+		s.log.Warnf("logit_bias has %d entries, more than %d, rejecting request", count, limit)
+		return nil, fmt.Errorf("%w: %d entries, limit is %d", ErrorLogitBiasTooLarge, count, limit)
+	}
+
+	s.log.Warnf("logit_bias has %d entries, more than %d, truncated", count, limit)
+	newBody, err := sjson.SetRawBytes(body, "logit_bias", []byte("{"+strings.Join(entries, ",")+"}"))
+	if err != nil {
+		return nil, s.logError("truncating logit_bias", err)
+	}
+	return newBody, nil
+}
+
+// injectDeadline sets the request timeout in seconds at DeadlineBodyPath so the upstream can
+// enforce it itself. A value already present in the body is kept.
+func (s *ProxyService) injectDeadline(body []byte) ([]byte, error) {
+	path := s.cfg.DeadlineBodyPath
+	if path == "" || gjson.GetBytes(body, path).Exists() {
+		return body, nil
+	}
+
+	newBody, err := sjson.SetBytes(body, path, s.cfg.TimeoutSeconds)
+	if err != nil {
+		return nil, s.logError("setting "+path, err)
+	}
+	return newBody, nil
+}
+
+// applySeed strips `seed` for the models listed in SeedStripModels, whose upstreams reject
+// it, and otherwise sets ChatDefaultSeed when the client sent no seed.
+func (s *ProxyService) applySeed(body []byte) ([]byte, error) {
+	model := gjson.GetBytes(body, "model").String()
+	for _, m := range s.cfg.SeedStripModels {
+		if m == model {
+			return s.deleteFields(body, []string{"seed"})
+		}
+	}
+
+	if s.cfg.ChatDefaultSeed == nil || gjson.GetBytes(body, "seed").Exists() {
+		return body, nil
+	}
+	return s.setJSONField(body, "seed", *s.cfg.ChatDefaultSeed)
+}
+
+// JSONResponseInstruction is prepended as a system message when response_format is forced
+// and no message mentions JSON, the upstream rejects json_object requests without one.
+const JSONResponseInstruction = "Respond with a JSON object."
+
+// forceJSONResponse sets response_format to json_object when it is absent and the model is
+// listed in JSONResponseModels, not every model supports it.
+func (s *ProxyService) forceJSONResponse(body []byte) ([]byte, error) {
+	if !s.cfg.ForceJSONResponse || gjson.GetBytes(body, "response_format").Exists() {
+		return body, nil
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	for _, allowed := range s.cfg.JSONResponseModels {
+		if allowed != model {
+			continue
+		}
+		newBody, err := sjson.SetRawBytes(body, "response_format", []byte(`{"type":"json_object"}`))
+		if err != nil {
+			return nil, s.logError("setting response_format", err)
+		}
+		return s.ensureJSONMention(newBody)
+	}
+	return body, nil
+}
+
+// ensureJSONMention prepends JSONResponseInstruction as a system message unless a message
+// already mentions JSON.
+func (s *ProxyService) ensureJSONMention(body []byte) ([]byte, error) {
+	messages := gjson.GetBytes(body, "messages").Array()
+	for _, msg := range messages {
+		if strings.Contains(strings.ToLower(messageText(msg)), "json") {
+			return body, nil
+		}
+	}
+
+	instruction, err := sjson.Set(`{"role":"system"}`, "content", JSONResponseInstruction)
+	if err != nil {
+		return nil, s.logError("building the JSON instruction", err)
+	}
+	raws := []string{instruction}
+	for _, msg := range messages {
+		raws = append(raws, msg.Raw)
+	}
+	newBody, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(raws, ",")+"]"))
+	if err != nil {
+		return nil, s.logError("setting messages", err)
+	}
+	return newBody, nil
+}
@@ -0,0 +1,676 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestReconcileAcceptStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        *ServiceConfig
+		accept     string
+		userAgent  string
+		body       string
+		wantStream bool
+	}{
+		{
+			name:   "disabled",
+			cfg:    &ServiceConfig{},
+			accept: "text/event-stream",
+			body:   `{"model":"m"}`,
+		},
+		{
+			name:       "event stream accepted",
+			cfg:        &ServiceConfig{RespectAcceptStream: true},
+			accept:     "text/event-stream",
+			body:       `{"model":"m"}`,
+			wantStream: true,
+		},
+		{
+			name:   "json accepted",
+			cfg:    &ServiceConfig{RespectAcceptStream: true},
+			accept: "application/json",
+			body:   `{"model":"m"}`,
+		},
+		{
+			name:      "non-stream agent",
+			cfg:       &ServiceConfig{RespectAcceptStream: true, NonStreamAgents: []string{"curl/"}},
+			accept:    "text/event-stream",
+			userAgent: "curl/8.5.0",
+			body:      `{"model":"m"}`,
+		},
+		{
+			name:       "explicit stream kept",
+			cfg:        &ServiceConfig{RespectAcceptStream: true},
+			accept:     "text/event-stream",
+			body:       `{"model":"m","stream":true}`,
+			wantStream: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Accept": {tt.accept}, "User-Agent": {tt.userAgent}}
+			out, err := newTestService(t, tt.cfg).reconcileAcceptStream([]byte(tt.body), header)
+			if err != nil {
+				t.Fatalf("reconcileAcceptStream() error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "stream").Bool(); got != tt.wantStream {
+				t.Errorf("stream = %v, want %v", got, tt.wantStream)
+			}
+		})
+	}
+}
+
+func TestApplyStopSequences(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ServiceConfig
+		body string
+		want []string
+	}{
+		{
+			name: "unconfigured",
+			cfg:  &ServiceConfig{},
+			body: `{"stop":["a","b","c","d","e"]}`,
+			want: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name: "oversized array truncated",
+			cfg:  &ServiceConfig{MaxStopSequences: 4},
+			body: `{"stop":["a","b","c","d","e"]}`,
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "string stop within limit",
+			cfg:  &ServiceConfig{MaxStopSequences: 4},
+			body: `{"stop":"a"}`,
+			want: []string{"a"},
+		},
+		{
+			name: "defaults merged after client stops",
+			cfg:  &ServiceConfig{DefaultStopSequences: []string{"\n\n", "a"}},
+			body: `{"stop":["a","b"]}`,
+			want: []string{"a", "b", "\n\n"},
+		},
+		{
+			name: "defaults without client stops",
+			cfg:  &ServiceConfig{DefaultStopSequences: []string{"\n\n"}},
+			body: `{}`,
+			want: []string{"\n\n"},
+		},
+		{
+			name: "client stops survive the clamp",
+			cfg:  &ServiceConfig{DefaultStopSequences: []string{"x", "y"}, MaxStopSequences: 3},
+			body: `{"stop":["a","b"]}`,
+			want: []string{"a", "b", "x"},
+		},
+		{
+			name: "merged list over the limit keeps the client stops",
+			cfg:  &ServiceConfig{DefaultStopSequences: []string{"x", "y"}, MaxStopSequences: 3},
+			body: `{"stop":["a","b","c","d"]}`,
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "model stops between client stops and defaults",
+			cfg:  &ServiceConfig{DefaultStopSequences: []string{"x"}, ModelStopSequences: map[string][]string{"m": {"<|end|>", "x"}}},
+			body: `{"model":"m","stop":["a"]}`,
+			want: []string{"a", "<|end|>", "x"},
+		},
+		{
+			name: "model stops without client stops",
+			cfg:  &ServiceConfig{ModelStopSequences: map[string][]string{"m": {"<|end|>"}}},
+			body: `{"model":"m"}`,
+			want: []string{"<|end|>"},
+		},
+		{
+			name: "other model unaffected",
+			cfg:  &ServiceConfig{ModelStopSequences: map[string][]string{"m": {"<|end|>"}}},
+			body: `{"model":"n","stop":["a"]}`,
+			want: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newTestService(t, tt.cfg).applyStopSequences([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("applyStopSequences() error = %v", err)
+			}
+			if got := stopSequences(out); !slices.Equal(got, tt.want) {
+				t.Errorf("stop = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionTextPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want []string
+	}{
+		{
+			name: "default chat path",
+			path: DefaultChatContentPath,
+			body: `{"choices":[{"message":{"content":"a"}},{"message":{"content":"b"}}]}`,
+			want: []string{"a", "b"},
+		},
+		{
+			name: "default codex path",
+			path: DefaultCodexTextPath,
+			body: `{"choices":[{"text":"a"},{"finish_reason":"stop"}]}`,
+			want: []string{"a"},
+		},
+		{
+			name: "custom array path",
+			path: "results.#.output.text",
+			body: `{"results":[{"output":{"text":"a"}}]}`,
+			want: []string{"a"},
+		},
+		{
+			name: "custom single value path",
+			path: "output",
+			body: `{"output":"a"}`,
+			want: []string{"a"},
+		},
+		{
+			name: "missing text",
+			path: "output",
+			body: `{"choices":[{"text":"a"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := completionTexts([]byte(tt.body), tt.path); !slices.Equal(got, tt.want) {
+				t.Errorf("completionTexts() = %q, want %q", got, tt.want)
+			}
+
+			out, err := rewriteCompletionTexts([]byte(tt.body), tt.path, strings.ToUpper)
+			if err != nil {
+				t.Fatalf("rewriteCompletionTexts() error = %v", err)
+			}
+			want := make([]string, 0, len(tt.want))
+			for _, text := range tt.want {
+				want = append(want, strings.ToUpper(text))
+			}
+			if got := completionTexts(out, tt.path); !slices.Equal(got, want) {
+				t.Errorf("rewritten texts = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeConsecutiveRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		body     string
+		want     string
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			body:     `{"messages":[{"role":"user","content":"a"},{"role":"user","content":"b"}]}`,
+			want:     `[{"role":"user","content":"a"},{"role":"user","content":"b"}]`,
+		},
+		{
+			name: "consecutive user messages",
+			body: `{"messages":[{"role":"user","content":"a"},{"role":"user","content":"b"},{"role":"user","content":"c"}]}`,
+			want: `[{"role":"user","content":"a\n\nb\n\nc"}]`,
+		},
+		{
+			name: "system message kept first",
+			body: `{"messages":[{"role":"system","content":"s"},{"role":"user","content":"a"},{"role":"user","content":"b"},{"role":"assistant","content":"c"},{"role":"user","content":"d"}]}`,
+			want: `[{"role":"system","content":"s"},{"role":"user","content":"a\n\nb"},{"role":"assistant","content":"c"},{"role":"user","content":"d"}]`,
+		},
+		{
+			name: "consecutive system messages",
+			body: `{"messages":[{"role":"system","content":"s"},{"role":"system","content":"t"},{"role":"user","content":"a"}]}`,
+			want: `[{"role":"system","content":"s\n\nt"},{"role":"user","content":"a"}]`,
+		},
+		{
+			name: "non-text content and tool results untouched",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"a"}]},{"role":"user","content":"b"},{"role":"tool","content":"r1"},{"role":"tool","content":"r2"}]}`,
+			want: `[{"role":"user","content":[{"type":"text","text":"a"}]},{"role":"user","content":"b"},{"role":"tool","content":"r1"},{"role":"tool","content":"r2"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{MergeConsecutiveRoles: !tt.disabled}
+			out, err := newTestService(t, cfg).mergeConsecutiveRoles([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("mergeConsecutiveRoles() error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "messages").Raw; got != tt.want {
+				t.Errorf("messages = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPenaltyMode(t *testing.T) {
+	body := `{"frequency_penalty":3.5,"presence_penalty":-4}`
+	tests := []struct {
+		name          string
+		mode          string
+		body          string
+		wantFrequency string
+		wantPresence  string
+	}{
+		{name: "passthrough", mode: PenaltyModePassthrough, body: body, wantFrequency: "3.5", wantPresence: "-4"},
+		{name: "clamp out of range", mode: PenaltyModeClamp, body: body, wantFrequency: "2", wantPresence: "-2"},
+		{name: "clamp within range", mode: PenaltyModeClamp, body: `{"frequency_penalty":0.5}`, wantFrequency: "0.5"},
+		{name: "strip", mode: PenaltyModeStrip, body: body},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newTestService(t, &ServiceConfig{PenaltyMode: tt.mode}).applyPenaltyMode([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("applyPenaltyMode() error = %v", err)
+			}
+			if got := gjson.GetBytes(out, "frequency_penalty").Raw; got != tt.wantFrequency {
+				t.Errorf("frequency_penalty = %q, want %q", got, tt.wantFrequency)
+			}
+			if got := gjson.GetBytes(out, "presence_penalty").Raw; got != tt.wantPresence {
+				t.Errorf("presence_penalty = %q, want %q", got, tt.wantPresence)
+			}
+		})
+	}
+}
+
+func TestApplyHeaderToBody(t *testing.T) {
+	mapping := map[string]string{"X-Copilot-Language": "metadata.language", "X-Copilot-Repo": "metadata.repo"}
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		header  http.Header
+		want    string
+	}{
+		{
+			name:   "no mapping",
+			header: http.Header{"X-Copilot-Language": {"go"}},
+			want:   `{"prompt":"p"}`,
+		},
+		{
+			name:    "present headers",
+			mapping: mapping,
+			header:  http.Header{"X-Copilot-Language": {"go"}, "X-Copilot-Repo": {"ldor"}},
+			want:    `{"prompt":"p","metadata":{"language":"go","repo":"ldor"}}`,
+		},
+		{
+			name:    "absent header skipped",
+			mapping: mapping,
+			header:  http.Header{"X-Copilot-Language": {"go"}},
+			want:    `{"prompt":"p","metadata":{"language":"go"}}`,
+		},
+		{
+			name:    "no header",
+			mapping: mapping,
+			header:  http.Header{},
+			want:    `{"prompt":"p"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newTestService(t, &ServiceConfig{HeaderToBody: tt.mapping}).applyHeaderToBody([]byte(`{"prompt":"p"}`), tt.header)
+			if err != nil {
+				t.Fatalf("applyHeaderToBody() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitLogitBias(t *testing.T) {
+	body := `{"logit_bias":{"1":1,"2":-1,"3":100}}`
+	tests := []struct {
+		name    string
+		limit   int
+		mode    string
+		want    string
+		wantErr error
+	}{
+		{name: "unlimited", want: body},
+		{name: "within limit", limit: 3, want: body},
+		{name: "truncated", limit: 2, mode: MessageOverflowTruncate, want: `{"logit_bias":{"1":1,"2":-1}}`},
+		{name: "rejected", limit: 2, mode: MessageOverflowReject, wantErr: ErrorLogitBiasTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{MaxLogitBiasEntries: tt.limit, LogitBiasOverflowMode: tt.mode})
+			out, err := s.limitLogitBias([]byte(body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("limitLogitBias() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogitBiasTooLargeRejected(t *testing.T) {
+	t.Parallel()
+	cfg := &ServiceConfig{MaxLogitBiasEntries: 1, LogitBiasOverflowMode: MessageOverflowReject}
+	tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, `{}`))
+
+	w := tp.do(http.MethodPost, "/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}],"logit_bias":{"1":1,"2":1}}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if calls := tp.upstreamCalls(); calls != 0 {
+		t.Errorf("upstream calls = %d, want 0", calls)
+	}
+}
+
+func TestInjectDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want string
+	}{
+		{name: "disabled", body: `{"prompt":"p"}`, want: `{"prompt":"p"}`},
+		{name: "injected", path: "timeout", body: `{"prompt":"p"}`, want: `{"prompt":"p","timeout":30}`},
+		{name: "nested path", path: "options.deadline", body: `{"prompt":"p"}`, want: `{"prompt":"p","options":{"deadline":30}}`},
+		{name: "client value kept", path: "timeout", body: `{"prompt":"p","timeout":5}`, want: `{"prompt":"p","timeout":5}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{DeadlineBodyPath: tt.path, TimeoutSeconds: 30})
+			out, err := s.injectDeadline([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("injectDeadline() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineForwarded(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{name: "codex", path: "/v1/engines/copilot-codex/completions", body: `{"prompt":"p"}`},
+		{name: "chat", path: "/v1/chat/completions", body: `{"messages":[{"role":"user","content":"hi"}]}`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &ServiceConfig{DeadlineBodyPath: "timeout", TimeoutSeconds: 45}
+			tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, `{"choices":[{"text":"a"}]}`))
+
+			if w := tp.do(http.MethodPost, tt.path, tt.body, nil); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			_, body := tp.lastUpstream(t)
+			if got := gjson.GetBytes(body, "timeout").Int(); got != 45 {
+				t.Errorf("upstream timeout = %d, want 45: %s", got, body)
+			}
+		})
+	}
+}
+
+func TestForceJSONResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		body     string
+		want     string
+	}{
+		{name: "disabled", disabled: true, body: `{"model":"gpt-4o"}`, want: `{"model":"gpt-4o"}`},
+		{
+			name: "allowed model",
+			body: `{"model":"gpt-4o","messages":[{"role":"user","content":"Answer in JSON."}]}`,
+			want: `{"model":"gpt-4o","messages":[{"role":"user","content":"Answer in JSON."}],"response_format":{"type":"json_object"}}`,
+		},
+		{
+			name: "instruction added when no message mentions json",
+			body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+			want: `{"model":"gpt-4o","messages":[{"role":"system","content":"Respond with a JSON object."},{"role":"user","content":"hi"}],"response_format":{"type":"json_object"}}`,
+		},
+		{
+			name: "json mentioned in a text part",
+			body: `{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"text","text":"return json"}]}]}`,
+			want: `{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"text","text":"return json"}]}],"response_format":{"type":"json_object"}}`,
+		},
+		{name: "model not allowed", body: `{"model":"gpt-3.5-turbo"}`, want: `{"model":"gpt-3.5-turbo"}`},
+		{
+			name: "client format kept",
+			body: `{"model":"gpt-4o","response_format":{"type":"text"}}`,
+			want: `{"model":"gpt-4o","response_format":{"type":"text"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{ForceJSONResponse: !tt.disabled, JSONResponseModels: []string{"gpt-4o"}})
+			out, err := s.forceJSONResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("forceJSONResponse() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestDowngradeSystemRole(t *testing.T) {
+	conversation := `{"model":"o1-mini","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name     string
+		disabled bool
+		mode     string
+		body     string
+		want     string
+	}{
+		{name: "disabled", disabled: true, mode: SystemRoleConvert, body: conversation, want: conversation},
+		{
+			name: "model not listed",
+			mode: SystemRoleConvert,
+			body: `{"model":"gpt-4","messages":[{"role":"system","content":"Be brief."}]}`,
+			want: `{"model":"gpt-4","messages":[{"role":"system","content":"Be brief."}]}`,
+		},
+		{
+			name: "convert",
+			mode: SystemRoleConvert,
+			body: conversation,
+			want: `{"model":"o1-mini","messages":[{"role":"user","content":"Be brief."},{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name: "merge into the first user message",
+			mode: SystemRoleMerge,
+			body: conversation,
+			want: `{"model":"o1-mini","messages":[{"role":"user","content":"Be brief.\n\nhi"}]}`,
+		},
+		{
+			name: "merge without a user message converts",
+			mode: SystemRoleMerge,
+			body: `{"model":"o1-mini","messages":[{"role":"system","content":"Be brief."}]}`,
+			want: `{"model":"o1-mini","messages":[{"role":"user","content":"Be brief."}]}`,
+		},
+		{
+			name: "no system message",
+			mode: SystemRoleMerge,
+			body: `{"model":"o1-mini","messages":[{"role":"user","content":"hi"}]}`,
+			want: `{"model":"o1-mini","messages":[{"role":"user","content":"hi"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{
+				DowngradeSystemRole: !tt.disabled,
+				SystemRoleModels:    []string{"o1-mini"},
+				SystemRoleMode:      tt.mode,
+			})
+			out, err := s.downgradeSystemRole([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("downgradeSystemRole() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySeed(t *testing.T) {
+	seed := int64(42)
+	tests := []struct {
+		name        string
+		defaultSeed *int64
+		body        string
+		want        string
+	}{
+		{name: "no default", body: `{"model":"m"}`, want: `{"model":"m"}`},
+		{name: "default injected", defaultSeed: &seed, body: `{"model":"m"}`, want: `{"model":"m","seed":42}`},
+		{name: "client seed kept", defaultSeed: &seed, body: `{"model":"m","seed":7}`, want: `{"model":"m","seed":7}`},
+		{name: "stripped for listed model", defaultSeed: &seed, body: `{"model":"o1","seed":7}`, want: `{"model":"o1"}`},
+		{name: "not injected for listed model", defaultSeed: &seed, body: `{"model":"o1"}`, want: `{"model":"o1"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{ChatDefaultSeed: tt.defaultSeed, SeedStripModels: []string{"o1"}})
+			out, err := s.applySeed([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("applySeed() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		body     string
+		want     string
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			body:     `{"prompt":"\ufeffa\r\nb"}`,
+			want:     `{"prompt":"\ufeffa\r\nb"}`,
+		},
+		{
+			name: "prompt and suffix",
+			body: `{"prompt":"\ufeffa\r\nb","suffix":"c\r\n"}`,
+			want: `{"prompt":"a\nb","suffix":"c\n"}`,
+		},
+		{
+			name: "chat message text",
+			body: `{"messages":[{"role":"user","content":"\ufeffa\r\nb"}]}`,
+			want: `{"messages":[{"role":"user","content":"a\nb"}]}`,
+		},
+		{
+			name: "chat text parts",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"a\r\nb"},{"type":"image_url","image_url":{"url":"u"}}]}]}`,
+			want: `{"messages":[{"role":"user","content":[{"type":"text","text":"a\nb"},{"type":"image_url","image_url":{"url":"u"}}]}]}`,
+		},
+		{
+			name: "lone CR and inner BOM kept",
+			body: `{"prompt":"a\rb\ufeff"}`,
+			want: `{"prompt":"a\rb\ufeff"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{NormalizePrompt: !tt.disabled})
+			out, err := s.normalizePrompt([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("normalizePrompt() error = %v", err)
+			}
+			for _, path := range []string{"prompt", "suffix", "messages"} {
+				if got, want := gjson.GetBytes(out, path).Value(), gjson.Get(tt.want, path).Value(); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("%s = %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitLogprobs(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLogprobs int
+		body        string
+		want        string
+	}{
+		{name: "absent", maxLogprobs: 2, body: `{"model":"m"}`, want: `{"model":"m"}`},
+		{name: "unlimited", body: `{"model":"m","logprobs":10}`, want: `{"model":"m","logprobs":10}`},
+		{name: "within limit", maxLogprobs: 5, body: `{"model":"m","logprobs":3}`, want: `{"model":"m","logprobs":3}`},
+		{name: "clamped", maxLogprobs: 5, body: `{"model":"m","logprobs":10}`, want: `{"model":"m","logprobs":5}`},
+		{name: "stripped for listed model", maxLogprobs: 5, body: `{"model":"codex-lite","logprobs":1}`, want: `{"model":"codex-lite"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{CodexMaxLogprobs: tt.maxLogprobs, NoLogprobsModels: []string{"codex-lite"}})
+			out, err := s.limitLogprobs([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("limitLogprobs() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestForceNonStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		body      string
+		want      string
+	}{
+		{name: "other agent", userAgent: "vscode/1.90", body: `{"stream":true}`, want: `{"stream":true}`},
+		{name: "listed agent", userAgent: "curl/8.5.0", body: `{"stream":true,"stream_options":{"include_usage":true}}`, want: `{"stream":false}`},
+		{name: "no stream requested", userAgent: "curl/8.5.0", body: `{"prompt":"p"}`, want: `{"prompt":"p"}`},
+		{name: "no user agent", body: `{"stream":true}`, want: `{"stream":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{NonStreamAgents: []string{"curl/", ""}})
+			out, err := s.forceNonStream([]byte(tt.body), http.Header{"User-Agent": {tt.userAgent}})
+			if err != nil {
+				t.Fatalf("forceNonStream() error = %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var ErrorMessageTooLarge = errors.New("message content too large")
+
+// truncateBytes cuts text down to at most limit bytes without splitting a rune,
+// keeping either its head or its tail.
+func truncateBytes(text string, limit int, mode string) string {
+	if len(text) <= limit {
+		return text
+	}
+	if limit <= 0 {
+		return ""
+	}
+
+	if mode == PromptTruncateKeepHead {
+		end := limit
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		return text[:end]
+	}
+	start := len(text) - limit
+	for start < len(text) && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	return text[start:]
+}
+
+// truncateText cuts text down to limit runes, keeping either its head or its tail.
+func truncateText(text string, limit int, mode string) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	if limit <= 0 {
+		return ""
+	}
+
+	runes := []rune(text)
+	if mode == PromptTruncateKeepHead {
+		return string(runes[:limit])
+	}
+	return string(runes[len(runes)-limit:])
+}
+
+// messageText returns the text of a chat message, only the text parts of an array content
+// are taken.
+func messageText(msg gjson.Result) string {
+	content := msg.Get("content")
+	if content.Type == gjson.String {
+		return content.Str
+	}
+	var text strings.Builder
+	for _, part := range content.Array() {
+		if part.Get("type").String() == "text" {
+			text.WriteString(part.Get("text").String())
+		}
+	}
+	return text.String()
+}
+
+// messageChars counts the characters of the text of a chat message.
+func messageChars(msg gjson.Result) int {
+	return utf8.RuneCountInString(messageText(msg))
+}
+
+// truncateChatMessages keeps the system messages and the most recent conversation turns
+// that fit into MaxPromptChars. The last message is always kept and its content cut if
+// necessary, an array content is kept whole.
+func (s *ProxyService) truncateChatMessages(body []byte) ([]byte, error) {
+	limit := s.cfg.MaxPromptChars
+	if limit <= 0 {
+		return body, nil
+	}
+
+	messages := gjson.GetBytes(body, "messages").Array()
+	if len(messages) == 0 {
+		return body, nil
+	}
+
+	total, budget := 0, limit
+	for _, msg := range messages {
+		n := messageChars(msg)
+		total += n
+		if msg.Get("role").String() == "system" {
+			budget -= n
+		}
+	}
+	if total <= limit {
+		return body, nil
+	}
+
+	last := len(messages) - 1
+	keep := make([]bool, len(messages))
+	for i := last; i >= 0; i-- {
+		if messages[i].Get("role").String() == "system" {
+			keep[i] = true
+			continue
+		}
+		n := messageChars(messages[i])
+		if i != last && n > budget {
+			break
+		}
+		keep[i] = true
+		budget -= n
+	}
+	for i := range messages {
+		if messages[i].Get("role").String() == "system" {
+			keep[i] = true
+		}
+	}
+
+	raws := make([]string, 0, len(messages))
+	dropped := 0
+	for i, msg := range messages {
+		if !keep[i] {
+			dropped++
+			continue
+		}
+		raw := msg.Raw
+		if content := msg.Get("content"); i == last && budget < 0 && content.Type == gjson.String {
+			cut := truncateText(content.Str, utf8.RuneCountInString(content.Str)+budget, s.cfg.PromptTruncateMode)
+			var err error
+			if raw, err = sjson.Set(raw, "content", cut); err != nil {
+				return nil, s.logError("truncating last message", err)
+			}
+		}
+		raws = append(raws, raw)
+	}
+
+	s.log.Warnf("Chat prompt exceeds %d chars (%d), dropped %d messages", limit, total, dropped)
+	newBody, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(raws, ",")+"]"))
+	if err != nil {
+		return nil, s.logError("setting messages", err)
+	}
+	return newBody, nil
+}
+
+// truncateCodePrompt keeps the FIM suffix intact where possible and cuts the prompt so
+// that prompt, suffix and the codex context prefix together fit into MaxPromptChars.
+func (s *ProxyService) truncateCodePrompt(body []byte) []byte {
+	if s.cfg.MaxPromptChars <= 0 {
+		return body
+	}
+	// The context prefix is prepended after truncation, it takes its share of the budget
+	limit := max(s.cfg.MaxPromptChars-utf8.RuneCountInString(s.cfg.codexContextPrefix), 0)
+
+	prompt := gjson.GetBytes(body, "prompt").String()
+	suffix := gjson.GetBytes(body, "suffix").String()
+	promptLen, suffixLen := utf8.RuneCountInString(prompt), utf8.RuneCountInString(suffix)
+	if promptLen+suffixLen <= limit {
+		return body
+	}
+
+	var err error
+	if suffixLen >= limit {
+		// The suffix alone is too long, keep the part closest to the cursor.
+		suffix = truncateText(suffix, limit, PromptTruncateKeepHead)
+		if body, err = sjson.SetBytes(body, "suffix", suffix); err != nil {
+			s.log.Errorf("Error setting suffix: %v", err)
+		}
+		prompt = ""
+	} else {
+		prompt = truncateText(prompt, limit-suffixLen, s.cfg.PromptTruncateMode)
+	}
+
+	if body, err = sjson.SetBytes(body, "prompt", prompt); err != nil {
+		s.log.Errorf("Error setting prompt: %v", err)
+	}
+
+	s.log.Warnf("Code prompt exceeds %d chars (%d), truncated with mode %s", limit, promptLen+suffixLen, s.cfg.PromptTruncateMode)
+	return body
+}
+
+// limitMessageContent enforces MaxMessageBytes on every individual chat message, either
+// cutting the oversized content or rejecting the request with ErrorMessageTooLarge.
+func (s *ProxyService) limitMessageContent(body []byte) ([]byte, error) {
+	limit := s.cfg.MaxMessageBytes
+	if limit <= 0 {
+		return body, nil
+	}
+
+	var err error
+	for i, msg := range gjson.GetBytes(body, "messages").Array() {
+		content := msg.Get("content")
+		if content.Type != gjson.String || len(content.Str) <= limit {
+			continue
+		}
+
+		if s.cfg.MessageOverflowMode == MessageOverflowReject {
+			s.log.Warnf("Chat message %d exceeds %d bytes (%d), rejecting request", i, limit, len(content.Str))
+			return nil, fmt.Errorf("%w: message %d has %d bytes, limit is %d", ErrorMessageTooLarge, i, len(content.Str), limit)
+		}
+
+		s.log.Warnf("Chat message %d exceeds %d bytes (%d), truncated with mode %s", i, limit, len(content.Str), s.cfg.PromptTruncateMode)
+		path := fmt.Sprintf("messages.%d.content", i)
+		if body, err = sjson.SetBytes(body, path, truncateBytes(content.Str, limit, s.cfg.PromptTruncateMode)); err != nil {
+			return nil, s.logError("truncating message content", err)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestTruncateCodePrompt(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        *ServiceConfig
+		prefix     string
+		body       string
+		wantPrompt string
+		wantSuffix string
+	}{
+		{
+			name:       "disabled",
+			cfg:        &ServiceConfig{},
+			body:       `{"prompt":"0123456789","suffix":"abc"}`,
+			wantPrompt: "0123456789",
+			wantSuffix: "abc",
+		},
+		{
+			name:       "fits",
+			cfg:        &ServiceConfig{MaxPromptChars: 13},
+			body:       `{"prompt":"0123456789","suffix":"abc"}`,
+			wantPrompt: "0123456789",
+			wantSuffix: "abc",
+		},
+		{
+			name:       "prompt tail kept",
+			cfg:        &ServiceConfig{MaxPromptChars: 8, PromptTruncateMode: PromptTruncateKeepTail},
+			body:       `{"prompt":"0123456789","suffix":"abc"}`,
+			wantPrompt: "56789",
+			wantSuffix: "abc",
+		},
+		{
+			name:       "suffix alone too long",
+			cfg:        &ServiceConfig{MaxPromptChars: 2, PromptTruncateMode: PromptTruncateKeepTail},
+			body:       `{"prompt":"0123456789","suffix":"abc"}`,
+			wantPrompt: "",
+			wantSuffix: "ab",
+		},
+		{
+			name:       "context prefix takes its share",
+			cfg:        &ServiceConfig{MaxPromptChars: 8, PromptTruncateMode: PromptTruncateKeepTail},
+			prefix:     "// ",
+			body:       `{"prompt":"0123456789","suffix":"abc"}`,
+			wantPrompt: "89",
+			wantSuffix: "abc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.codexContextPrefix = tt.prefix
+			out := newTestService(t, tt.cfg).truncateCodePrompt([]byte(tt.body))
+			if got := gjson.GetBytes(out, "prompt").String(); got != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", got, tt.wantPrompt)
+			}
+			if got := gjson.GetBytes(out, "suffix").String(); got != tt.wantSuffix {
+				t.Errorf("suffix = %q, want %q", got, tt.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		mode  string
+		want  string
+	}{
+		{name: "fits", text: "héllo", limit: 5, mode: PromptTruncateKeepTail, want: "héllo"},
+		{name: "keep tail", text: "héllo wörld", limit: 5, mode: PromptTruncateKeepTail, want: "wörld"},
+		{name: "keep head", text: "héllo wörld", limit: 5, mode: PromptTruncateKeepHead, want: "héllo"},
+		{name: "no budget", text: "héllo", limit: 0, mode: PromptTruncateKeepTail, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateText(tt.text, tt.limit, tt.mode); got != tt.want {
+				t.Errorf("truncateText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateChatMessages(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		body  string
+		want  []string
+	}{
+		{
+			name:  "disabled",
+			limit: 0,
+			body:  `{"messages":[{"role":"user","content":"0123456789"}]}`,
+			want:  []string{"0123456789"},
+		},
+		{
+			name:  "fits",
+			limit: 20,
+			body:  `{"messages":[{"role":"system","content":"sys"},{"role":"user","content":"0123456789"}]}`,
+			want:  []string{"sys", "0123456789"},
+		},
+		{
+			name:  "oldest turns dropped, system kept",
+			limit: 10,
+			body:  `{"messages":[{"role":"system","content":"sys"},{"role":"user","content":"first"},{"role":"assistant","content":"reply"},{"role":"user","content":"last"}]}`,
+			want:  []string{"sys", "last"},
+		},
+		{
+			name:  "last message cut",
+			limit: 8,
+			body:  `{"messages":[{"role":"system","content":"sys"},{"role":"user","content":"0123456789"}]}`,
+			want:  []string{"sys", "56789"},
+		},
+		{
+			name:  "array content counted by its text parts",
+			limit: 10,
+			body:  `{"messages":[{"role":"user","content":"first"},{"role":"user","content":[{"type":"text","text":"look"},{"type":"image_url","image_url":{"url":"https://example.com/image.png"}}]}]}`,
+			want:  []string{"first", `[{"type":"text","text":"look"},{"type":"image_url","image_url":{"url":"https://example.com/image.png"}}]`},
+		},
+		{
+			name:  "array last message kept whole",
+			limit: 6,
+			body:  `{"messages":[{"role":"user","content":"first"},{"role":"user","content":[{"type":"text","text":"0123456789"}]}]}`,
+			want:  []string{`[{"type":"text","text":"0123456789"}]`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, &ServiceConfig{MaxPromptChars: tt.limit, PromptTruncateMode: PromptTruncateKeepTail})
+			out, err := s.truncateChatMessages([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("truncateChatMessages() error = %v", err)
+			}
+			var got []string
+			for _, content := range gjson.GetBytes(out, "messages.#.content").Array() {
+				got = append(got, content.String())
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitMessageContent(t *testing.T) {
+	body := `{"messages":[{"role":"system","content":"short"},{"role":"user","content":"0123456789"}]}`
+	tests := []struct {
+		name    string
+		cfg     *ServiceConfig
+		want    string
+		wantErr error
+	}{
+		{
+			name: "disabled",
+			cfg:  &ServiceConfig{},
+			want: "0123456789",
+		},
+		{
+			name: "truncate keeps the tail",
+			cfg:  &ServiceConfig{MaxMessageBytes: 6},
+			want: "456789",
+		},
+		{
+			name: "truncate keeps the head",
+			cfg:  &ServiceConfig{MaxMessageBytes: 6, PromptTruncateMode: PromptTruncateKeepHead},
+			want: "012345",
+		},
+		{
+			name:    "reject",
+			cfg:     &ServiceConfig{MaxMessageBytes: 6, MessageOverflowMode: MessageOverflowReject},
+			wantErr: ErrorMessageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newDefaultTestService(t, tt.cfg).limitMessageContent([]byte(body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("limitMessageContent() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "message 1") {
+					t.Errorf("error = %v, want the message index", err)
+				}
+				return
+			}
+			if got := gjson.GetBytes(out, "messages.0.content").String(); got != "short" {
+				t.Errorf("short message = %q, want it untouched", got)
+			}
+			if got := gjson.GetBytes(out, "messages.1.content").String(); got != tt.want {
+				t.Errorf("long message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageTooLargeRejected(t *testing.T) {
+	t.Parallel()
+	cfg := &ServiceConfig{MaxMessageBytes: 6, MessageOverflowMode: MessageOverflowReject}
+	tp := newTestProxy(t, cfg, respondJSON(http.StatusOK, `{}`))
+
+	w := tp.do(http.MethodPost, "/v1/chat/completions", `{"messages":[{"role":"user","content":"0123456789"}]}`, nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if calls := tp.upstreamCalls(); calls != 0 {
+		t.Errorf("upstream calls = %d, want 0", calls)
+	}
+}
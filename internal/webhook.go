@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+var ErrorWebhookFailed = errors.New("transform webhook failed")
+
+// applyTransformWebhook posts the prepared request body to WebhookURL and returns the body
+// it answers with. When the webhook fails, fail-open keeps the original body and fail-closed
+// returns ErrorWebhookFailed.
+func (s *ProxyService) applyTransformWebhook(c *gin.Context, body []byte) ([]byte, error) {
+	if s.cfg.WebhookURL == "" {
+		return body, nil
+	}
+
+	transformed, err := s.callTransformWebhook(c, body)
+	if err == nil {
+		return transformed, nil
+	}
+
+	if s.cfg.WebhookFailMode == FailModeClosed {
+		s.log.Errorf("Transform webhook failed, rejecting request: %v", err)
+		return nil, fmt.Errorf("%w: %w", ErrorWebhookFailed, err)
+	}
+	s.log.Warnf("Transform webhook failed, forwarding the untransformed body: %v", err)
+	return body, nil
+}
+
+func (s *ProxyService) callTransformWebhook(c *gin.Context, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.WebhookTimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderRoute, c.FullPath())
+	req.Header.Set(HeaderModel, c.GetString(ContextKeyModel))
+
+	resp, err := s.hookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	transformed, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if !gjson.ValidBytes(transformed) {
+		return nil, errors.New("response is not valid JSON")
+	}
+	return transformed, nil
+}
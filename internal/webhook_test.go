@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApplyTransformWebhook(t *testing.T) {
+	const body = `{"model":"m"}`
+
+	tests := []struct {
+		name     string
+		failMode string
+		handler  http.HandlerFunc
+		want     string
+		wantErr  error
+	}{
+		{
+			name: "transformed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				in, _ := io.ReadAll(r.Body)
+				w.Write(append(in[:len(in)-1], `,"user":"u"}`...))
+			},
+			want: `{"model":"m","user":"u"}`,
+		},
+		{
+			name:     "fail open keeps the body",
+			failMode: FailModeOpen,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			want: body,
+		},
+		{
+			name:     "fail closed rejects",
+			failMode: FailModeClosed,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("not json"))
+			},
+			wantErr: ErrorWebhookFailed,
+		},
+		{
+			name:     "slow webhook times out",
+			failMode: FailModeClosed,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(200 * time.Millisecond):
+				case <-r.Context().Done():
+				}
+			},
+			wantErr: ErrorWebhookFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			cfg := &ServiceConfig{WebhookURL: server.URL, WebhookFailMode: tt.failMode, WebhookTimeoutMs: 50, MinTLSVersion: DefaultMinTLSVersion}
+			s := newTestService(t, cfg)
+			client, err := createHTTPClient(cfg)
+			if err != nil {
+				t.Fatalf("createHTTPClient() error = %v", err)
+			}
+			client.Timeout = time.Duration(cfg.WebhookTimeoutMs) * time.Millisecond
+			s.hookClient = client
+
+			out, err := s.applyTransformWebhook(newTestContext(), []byte(body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyTransformWebhook() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(out) != tt.want {
+				t.Errorf("body = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
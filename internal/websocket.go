@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"golang.org/x/net/websocket"
+)
+
+var ErrorWebSocketOrigin = errors.New("websocket origin not allowed")
+
+// handleWebSocket serves handler over a WebSocket. The first message of the client is the
+// request body, the response is sent back as one message per stream event, or as a single
+// message when the upstream does not stream. Closing the socket cancels the upstream call.
+func (ps *ProxyService) handleWebSocket(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		server := websocket.Server{
+			Handshake: func(_ *websocket.Config, req *http.Request) error {
+				return ps.checkWebSocketOrigin(req.Header.Get("Origin"))
+			},
+			Handler: func(ws *websocket.Conn) {
+				ps.serveWebSocket(c, ws, handler)
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// checkWebSocketOrigin rejects cross-site handshakes. Non-browser clients send no Origin and
+// are guarded by the auth token, browser pages must be listed in WebSocketOrigins, as any site
+// could otherwise open a socket with the credentials of the browser.
+func (ps *ProxyService) checkWebSocketOrigin(origin string) error {
+	if origin == "" || slices.Contains(ps.cfg.WebSocketOrigins, origin) {
+		return nil
+	}
+	ps.log.Warnf("WebSocket handshake from origin %q rejected", origin)
+	return ErrorWebSocketOrigin
+}
+
+func (ps *ProxyService) serveWebSocket(c *gin.Context, ws *websocket.Conn, handler gin.HandlerFunc) {
+	defer ws.Close()
+
+	var body []byte
+	if err := websocket.Message.Receive(ws, &body); err != nil {
+		ps.log.Warnf("Failed to receive WebSocket request: %v", err)
+		return
+	}
+
+	// A hijacked connection does not cancel the request context, watch the socket instead
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		cancel()
+	}()
+
+	req := c.Request.Clone(ctx)
+	req.Method = http.MethodPost
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	writer := &webSocketResponseWriter{ResponseWriter: c.Writer, ws: ws, header: make(http.Header), status: http.StatusOK}
+	origReq, origWriter := c.Request, c.Writer
+	c.Request, c.Writer = req, writer
+	handler(c)
+	c.Request, c.Writer = origReq, origWriter
+	if err := writer.close(); err != nil {
+		ps.log.Warnf("Failed to send WebSocket response: %v", err)
+	}
+}
+
+// webSocketResponseWriter turns the response written by a handler into WebSocket messages.
+// Stream events are sent as they complete, with the "data: " prefix removed, any other body
+// is buffered and sent when the handler returns. An error status is sent as an error frame.
+type webSocketResponseWriter struct {
+	gin.ResponseWriter
+	ws      *websocket.Conn
+	header  http.Header
+	status  int
+	size    int
+	written bool
+	pending []byte
+}
+
+func (w *webSocketResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *webSocketResponseWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *webSocketResponseWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *webSocketResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+	w.size += len(data)
+	w.pending = append(w.pending, data...)
+	if !isEventStream(w.header.Get("Content-Type")) {
+		return len(data), nil
+	}
+
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		line := bytes.TrimSpace(w.pending[:i])
+		w.pending = w.pending[i+1:]
+		if payload, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if err := websocket.Message.Send(w.ws, string(bytes.TrimSpace(payload))); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func (w *webSocketResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *webSocketResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *webSocketResponseWriter) Size() int {
+	return w.size
+}
+
+func (w *webSocketResponseWriter) Written() bool {
+	return w.written
+}
+
+// Flush is a no-op, every message is sent as soon as it is complete.
+func (w *webSocketResponseWriter) Flush() {}
+
+// close sends what is left of the response.
+func (w *webSocketResponseWriter) close() error {
+	if w.status >= http.StatusBadRequest {
+		return websocket.Message.Send(w.ws, string(w.errorFrame()))
+	}
+	if len(bytes.TrimSpace(w.pending)) == 0 {
+		return nil
+	}
+	return websocket.Message.Send(w.ws, string(w.pending))
+}
+
+// errorFrame returns the buffered error body with the response status added to it, a body
+// that is not a JSON object becomes the "error" field of a new one.
+func (w *webSocketResponseWriter) errorFrame() []byte {
+	frame := w.pending
+	if !gjson.ValidBytes(frame) || !gjson.ParseBytes(frame).IsObject() {
+		frame, _ = sjson.SetBytes([]byte(`{}`), "error", string(bytes.TrimSpace(w.pending)))
+	}
+	if withStatus, err := sjson.SetBytes(frame, "status", w.status); err == nil {
+		frame = withStatus
+	}
+	return frame
+}
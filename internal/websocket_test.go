@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
+)
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		wantErr error
+	}{
+		{name: "no origin", origin: ""},
+		{name: "allowed origin", origin: "https://app.example.com", allowed: []string{"https://app.example.com"}},
+		{name: "cross-site origin", origin: "https://evil.example.com", allowed: []string{"https://app.example.com"}, wantErr: ErrorWebSocketOrigin},
+		{name: "no allowlist", origin: "https://app.example.com", wantErr: ErrorWebSocketOrigin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestService(t, &ServiceConfig{WebSocketOrigins: tt.allowed})
+			if err := ps.checkWebSocketOrigin(tt.origin); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkWebSocketOrigin() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	const allowed = "https://app.example.com"
+
+	tests := []struct {
+		name    string
+		origin  string
+		handler gin.HandlerFunc
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "json response",
+			origin: allowed,
+			handler: func(c *gin.Context) {
+				c.Data(http.StatusOK, "application/json", []byte(`{"ok":true}`))
+			},
+			want: []string{`{"ok":true}`},
+		},
+		{
+			name:   "stream events",
+			origin: allowed,
+			handler: func(c *gin.Context) {
+				c.Header("Content-Type", "text/event-stream")
+				c.Writer.WriteString("data: {\"n\":1}\n\ndata: [DONE]\n\n")
+			},
+			want: []string{`{"n":1}`, "[DONE]"},
+		},
+		{
+			name:   "error status",
+			origin: allowed,
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			},
+			want: []string{`{"error":"Too many requests","status":429}`},
+		},
+		{
+			name:   "plain text error",
+			origin: allowed,
+			handler: func(c *gin.Context) {
+				c.Data(http.StatusNotFound, "text/plain", []byte("404 page not found"))
+			},
+			want: []string{`{"error":"404 page not found","status":404}`},
+		},
+		{
+			name:    "cross-site origin is rejected",
+			origin:  "https://evil.example.com",
+			handler: func(c *gin.Context) {},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestService(t, &ServiceConfig{WebSocketOrigins: []string{allowed}})
+			restored := make(chan bool, 1)
+			router := gin.New()
+			router.GET("/ws", func(c *gin.Context) {
+				req, writer := c.Request, c.Writer
+				ps.handleWebSocket(tt.handler)(c)
+				restored <- c.Request == req && c.Writer == writer
+			})
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/ws", "", tt.origin)
+			if tt.wantErr {
+				if err == nil {
+					ws.Close()
+					t.Fatal("handshake succeeded, want rejection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.Close()
+
+			if err := websocket.Message.Send(ws, `{"stream":true}`); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			for _, want := range tt.want {
+				var got string
+				if err := websocket.Message.Receive(ws, &got); err != nil {
+					t.Fatalf("receive: %v", err)
+				}
+				if got != want {
+					t.Errorf("message = %q, want %q", got, want)
+				}
+			}
+			ws.Close()
+			if !<-restored {
+				t.Error("context request and writer not restored")
+			}
+		})
+	}
+}
+
+func TestWebSocketUpstreamError(t *testing.T) {
+	t.Parallel()
+	tp := newTestProxy(t, &ServiceConfig{EnableWebSocket: true, WebSocketOrigins: []string{"http://localhost"}}, respondJSON(http.StatusInternalServerError, `{"error":"down"}`))
+	server := httptest.NewServer(tp.router)
+	t.Cleanup(server.Close)
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/v1/engines/copilot-codex/completions", "", "http://localhost")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	if err := websocket.Message.Send(ws, `{"prompt":"p","stream":true}`); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var got string
+	if err := websocket.Message.Receive(ws, &got); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if status := gjson.Get(got, "status").Int(); status != http.StatusInternalServerError || !gjson.Get(got, "error").Exists() {
+		t.Errorf("message = %s, want an error frame with status %d", got, http.StatusInternalServerError)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/shengyanli1982/gs"
@@ -29,6 +33,7 @@ func main() {
 		logger                                         *zap.SugaredLogger
 		zapWriter                                      zapcore.WriteSyncer
 		isReleaseMode, isPlainLogMode, isFullDebugMode bool
+		isMissingConfigAllowed                         bool
 	)
 
 	rootCmd := cobra.Command{
@@ -36,7 +41,8 @@ func main() {
 		Short: "ldor is copilot(linux do) override service",
 		Long:  "ldor is a proxy service that forwards requests to a target server and returns the response.",
 	}
-	rootCmd.Flags().StringVarP(&configFilePath, "config", "c", "./config.json", "Configuration file path")
+	rootCmd.Flags().StringVarP(&configFilePath, "config", "c", "", "Configuration file path (default: first found of ./config.json, /etc/ldor/config.json, $XDG_CONFIG_HOME/ldor/config.json)")
+	rootCmd.Flags().BoolVar(&isMissingConfigAllowed, "allow-missing-config", false, "Start with default settings when no config file is found")
 	rootCmd.Flags().StringVarP(&logSaveFilePath, "logs", "l", "", "Output console log save file path (default: \"\"). All log files will be saved 500mb per file, 30 store days, and the maximum number of log files is 10.")
 	rootCmd.Flags().BoolVarP(&isReleaseMode, "release", "r", false, "Set release mode")
 	rootCmd.Flags().BoolVarP(&isPlainLogMode, "plain", "p", false, "Set plain text log mode, default is json log mode (only valid in release mode)")
@@ -48,7 +54,7 @@ func main() {
 		os.Exit(-1)
 	}
 
-	appConfig, err := loadServiceConfig(configFilePath)
+	appConfig, configFilePath, err := loadServiceConfig(configFilePath, isMissingConfigAllowed)
 	if err != nil {
 		fmt.Printf("Failed to load config: %v", err)
 		os.Exit(-1)
@@ -64,7 +70,14 @@ func main() {
 	rateLimiter := rl.NewRateLimiter(rateLimiterConfig)
 
 	orbitConfig := orbit.NewConfig().WithAccessLogEventFunc(func(logger *zap.SugaredLogger, event *log.LogEvent) {
-		logger.Infow("http server access log", "id", event.ID, "endpoint", event.EndPoint, "method", event.Method, "code", event.Code, "status", event.Status, "latency", event.Latency, "user-agent", event.Agent, "error", event.Error, "stack", event.ErrorStack)
+		switch appConfig.AccessLogFormat {
+		case il.AccessLogFormatCombined:
+			_, _ = zapWriter.Write([]byte(il.FormatCombinedLogLine(event, time.Now())))
+		case il.AccessLogFormatText:
+			logger.Infof("http server access log: %s %s %s %d %s %q", event.IP, event.Method, event.Path, event.Code, event.Latency, event.Agent)
+		default:
+			logger.Infow("http server access log", "id", event.ID, "endpoint", event.EndPoint, "method", event.Method, "code", event.Code, "status", event.Status, "latency", event.Latency, "user-agent", event.Agent, "error", event.Error, "stack", event.ErrorStack)
+		}
 	})
 
 	orbitOptions := orbit.NewOptions().EnableMetric()
@@ -93,6 +106,16 @@ func main() {
 		logger = il.NewLogger(zapWriter).GetZapSugaredLogger().Named("default")
 	}
 
+	if appConfig.Environment != "" {
+		logger = logger.With("environment", appConfig.Environment)
+	}
+
+	if configFilePath != "" {
+		logger.Infof("Using config file: %s", configFilePath)
+	} else {
+		logger.Warnf("No config file found, using default settings")
+	}
+
 	proxyService, err := il.NewProxyService(appConfig, logger, rateLimiter)
 	if err != nil {
 		logger.Errorf("Failed to create proxy service: %v", err)
@@ -107,30 +130,62 @@ func main() {
 
 	orbitEngine := orbit.NewEngine(orbitConfig, orbitOptions)
 
+	if appConfig.MaxHeaderBytes > 0 {
+		orbitEngine.RegisterMiddleware(il.MaxHeaderBytesMiddleware(appConfig.MaxHeaderBytes, appConfig.ErrorMessages))
+	}
+
 	if isFullDebugMode && !isReleaseMode {
-		orbitEngine.RegisterMiddleware(logFullRequestAndResponseBody(logger))
+		orbitEngine.RegisterMiddleware(logFullRequestAndResponseBody(logger, appConfig.DebugMaxMessages))
+		proxyService.SetDebugMode(true)
 	}
 
 	orbitEngine.RegisterService(proxyService)
 	orbitEngine.Run()
+	logger.Infow("Registered routes", "authEnabled", appConfig.AuthToken != "", "routes", proxyService.Routes())
 
 	engineStopSignal := gs.NewTerminateSignal()
-	engineStopSignal.RegisterCancelHandles(orbitEngine.Stop, rateLimiter.Stop)
+	engineStopSignal.RegisterCancelHandles(proxyService.Drain, orbitEngine.Stop, proxyService.Stop, rateLimiter.Stop)
 
 	writerStopSignal := gs.NewTerminateSignal()
 	if isReleaseMode {
 		writerStopSignal.RegisterCancelHandles(asyncLogWriter.Stop)
 	}
 
+	forwardTerminateSignal()
 	gs.WaitForForceSync(engineStopSignal, writerStopSignal)
 }
 
-func loadServiceConfig(configFilePath string) (*il.ServiceConfig, error) {
+// forwardTerminateSignal turns SIGTERM into SIGINT, gs only waits for the latter and
+// container runtimes stop processes with the former.
+func forwardTerminateSignal() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM)
+	go func() {
+		<-quit
+		signal.Stop(quit)
+		if process, err := os.FindProcess(os.Getpid()); err == nil {
+			_ = process.Signal(os.Interrupt)
+		}
+	}()
+}
+
+// loadServiceConfig loads the config from configFilePath, or from the first file found in
+// il.ConfigSearchPaths when no path was given, and returns the path that was used. When
+// allowMissing is set and no file exists, the defaults are used and the path is empty.
+func loadServiceConfig(configFilePath string, allowMissing bool) (*il.ServiceConfig, string, error) {
 	appConfig := il.NewServiceConfig()
-	if err := appConfig.LoadConfig(configFilePath); err != nil {
-		return nil, err
+
+	configFilePath, err := il.FindConfigFile(configFilePath)
+	if err == nil {
+		err = appConfig.LoadConfig(configFilePath)
+	}
+	if errors.Is(err, il.ErrorConfigNotFound) && allowMissing {
+		return appConfig, "", appConfig.LoadDefaults()
 	}
-	return appConfig, nil
+	if err != nil {
+		return nil, "", err
+	}
+	return appConfig, configFilePath, nil
 }
 
 func parseServerAddress(address string) (string, int, error) {
@@ -145,7 +200,9 @@ func parseServerAddress(address string) (string, int, error) {
 	return host, port, nil
 }
 
-func logFullRequestAndResponseBody(logger *zap.SugaredLogger) func(*gin.Context) {
+// logFullRequestAndResponseBody logs both bodies of every request, chat conversations longer
+// than maxMessages are elided in the log.
+func logFullRequestAndResponseBody(logger *zap.SugaredLogger, maxMessages int) func(*gin.Context) {
 	return func(c *gin.Context) {
 		requestBody, err := httptool.GenerateRequestBody(c)
 		if err != nil {
@@ -155,7 +212,11 @@ func logFullRequestAndResponseBody(logger *zap.SugaredLogger) func(*gin.Context)
 
 		c.Next()
 
-		logger.Infof("Request body ---> %s", requestBody)
+		if maxMessages > 0 {
+			logger.Infof("Request body (%d bytes) ---> %s", len(requestBody), il.ElideMessages(requestBody, maxMessages))
+		} else {
+			logger.Infof("Request body ---> %s", requestBody)
+		}
 
 		responseBody, err := httptool.GenerateResponseBody(c)
 		if err != nil {
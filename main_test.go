@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	il "github.com/shengyanli1982/ldor/internal"
+)
+
+func TestLoadServiceConfig(t *testing.T) {
+	dir := t.TempDir()
+	validFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(validFile, []byte(`{"timeout":30}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	malformedFile := filepath.Join(dir, "malformed.json")
+	if err := os.WriteFile(malformedFile, []byte(`{`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missingFile := filepath.Join(dir, "missing.json")
+
+	tests := []struct {
+		name         string
+		path         string
+		allowMissing bool
+		wantPath     string
+		wantTimeout  int
+		wantErr      error
+	}{
+		{name: "existing file", path: validFile, wantPath: validFile, wantTimeout: 30},
+		{name: "missing file", path: missingFile, wantErr: il.ErrorConfigNotFound},
+		{name: "missing file allowed", path: missingFile, allowMissing: true, wantTimeout: 600},
+		{name: "malformed file still fails", path: malformedFile, allowMissing: true, wantErr: il.ErrorConfigMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, path, err := loadServiceConfig(tt.path, tt.allowMissing)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("loadServiceConfig() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if path != tt.wantPath {
+				t.Errorf("path = %q, want %q", path, tt.wantPath)
+			}
+			if cfg.TimeoutSeconds != tt.wantTimeout {
+				t.Errorf("TimeoutSeconds = %d, want %d", cfg.TimeoutSeconds, tt.wantTimeout)
+			}
+		})
+	}
+}